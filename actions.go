@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/atotto/clipboard"
@@ -13,6 +14,15 @@ const (
 	actionCopySelected      string = "copyselected"
 	actionCopyFromChat      string = "copy"
 	actionSwitchToSelection string = "selcode"
+	actionSelectMessage     string = "selmsg"
+	actionEditSelected      string = "editselected"
+	actionNextBranch        string = "nextbranch"
+	actionPrevBranch        string = "prevbranch"
+	actionNextAnswer        string = "nextanswer"
+	actionPrevAnswer        string = "prevanswer"
+	actionRegenerate        string = "regen"
+	actionUndo              string = "undo"
+	actionEdit              string = "edit"
 )
 
 type Action interface {
@@ -29,6 +39,59 @@ func parseAction(prompt string) (Action, error) {
 		return SelectCodeAction{}, nil
 	case actionCopySelected:
 		return CopySelectedAction{}, nil
+	case "sm", "fork", actionSelectMessage:
+		return SelectMessageAction{}, nil
+	case actionEditSelected:
+		return EditSelectedAction{}, nil
+	case "bn", actionNextBranch:
+		return SwitchBranchAction{delta: 1}, nil
+	case "bp", actionPrevBranch:
+		return SwitchBranchAction{delta: -1}, nil
+	case "retry", actionRegenerate:
+		return RegenerateAction{}, nil
+	case actionUndo:
+		return UndoAction{}, nil
+	case actionEdit:
+		return EditLastAction{}, nil
+	case "model":
+		if len(parts) == 1 {
+			return nil, errors.New("usage: model <name>")
+		}
+		return SetModelAction{model: gptModel(strings.TrimSpace(parts[1]))}, nil
+	case "system":
+		if len(parts) == 1 {
+			return nil, errors.New("usage: system <text>")
+		}
+		return SetSystemAction{content: strings.TrimSpace(parts[1])}, nil
+	case "prompt":
+		if len(parts) == 1 {
+			return nil, errors.New("usage: prompt <topic>")
+		}
+		return UsePersonaAction{name: strings.TrimSpace(parts[1])}, nil
+	case "params":
+		return ShowParamsAction{}, nil
+	case "an", actionNextAnswer:
+		return ChooseAnswerAction{delta: 1}, nil
+	case "ap", actionPrevAnswer:
+		return ChooseAnswerAction{delta: -1}, nil
+	case "choose":
+		if len(parts) == 1 {
+			return nil, errors.New("usage: choose <answer number>")
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid answer number: %s", parts[1])
+		}
+		return ChooseAnswerAction{index: n}, nil
+	case "set":
+		if len(parts) == 1 {
+			return nil, errors.New("usage: set <parameter> <value>")
+		}
+		param := strings.SplitN(strings.TrimSpace(parts[1]), " ", 2)
+		if len(param) == 1 {
+			return SetParamAction{name: param[0]}, nil
+		}
+		return SetParamAction{name: param[0], value: param[1]}, nil
 	case "cc", "yc":
 		return CopyCodeAction{}, nil
 	case "ca", "ya":
@@ -85,7 +148,12 @@ func (x CopyAllAction) Exec(m model) (model, error) {
 		case roleUser:
 			content.WriteString("- me: ")
 		case roleGpt:
+			if m.Content == "" {
+				continue // Only asked for tools
+			}
 			content.WriteString("- gpt: ")
+		case roleTool:
+			continue
 		}
 		content.WriteString(m.Content)
 		content.WriteString("\n\n")
@@ -134,3 +202,225 @@ func (x CopySelectedAction) Exec(m model) (model, error) {
 	m.setMode(modeChat)
 	return m, clipboard.WriteAll(strings.TrimSpace(c.code))
 }
+
+type SelectMessageAction struct{}
+
+func (x SelectMessageAction) Exec(m model) (model, error) {
+	lst := []list.Item{}
+	for idx, msg := range m.convo {
+		if msg.Role != roleUser {
+			continue
+		}
+		lst = append(lst, messageItem{idx: idx, content: msg.Content})
+	}
+	if len(lst) == 0 {
+		return m, errors.New("no messages to edit")
+	}
+	m.setMode(modeSelectMessage)
+	m.list.SetItems(lst)
+	m.list.Select(len(lst) - 1)
+	return m, nil
+}
+
+type messageItem struct {
+	idx     int
+	content string
+}
+
+func (x messageItem) FilterValue() string { return x.content }
+func (x messageItem) Title() string       { return fmt.Sprintf("Message %0d", x.idx+1) }
+func (x messageItem) Description() string { return strings.Replace(x.content, "\n", " ", -1) }
+
+type EditSelectedAction struct{}
+
+func (x EditSelectedAction) Exec(m model) (model, error) {
+	msg, ok := m.list.SelectedItem().(messageItem)
+	if !ok {
+		return m, errors.New("no message selected")
+	}
+	m.list.SetItems([]list.Item{})
+	m.setMode(modeChat)
+
+	// Sending the edited message forks a new branch from this point
+	m.convo = m.convo[:msg.idx]
+	m.prompt.SetValue(msg.content)
+	return m, nil
+}
+
+type SwitchBranchAction struct {
+	delta int
+}
+
+func (x SwitchBranchAction) Exec(m model) (model, error) {
+	if m.tree == nil {
+		return m, errors.New("no branches")
+	}
+	m.tree.Set(m.convo)
+	if m.tree.LastFork() < 0 {
+		return m, errors.New("no branches")
+	}
+	m.convo = m.tree.Cycle(x.delta)
+	return m, m.save()
+}
+
+type SetParamAction struct {
+	name, value string
+}
+
+func (x SetParamAction) Exec(m model) (model, error) {
+	params := m.opts.params
+	if err := params.Set(x.name, x.value); err != nil {
+		return m, err
+	}
+	m.opts.params = params
+	if err := m.save(); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// ChooseAnswerAction keeps another of the answers to the last question,
+// either the one numbered index or the one delta away from the current.
+type ChooseAnswerAction struct {
+	delta, index int
+}
+
+func (x ChooseAnswerAction) Exec(m model) (model, error) {
+	idx := len(m.convo) - 1
+	if idx < 0 || len(m.convo[idx].Alternatives) < 2 {
+		return m, errors.New("no other answers")
+	}
+	msg := m.convo[idx]
+	choice := x.index - 1
+	if x.index == 0 {
+		total := len(msg.Alternatives)
+		choice = ((msg.Choice+x.delta)%total + total) % total
+	}
+	msg, err := msg.Choose(choice)
+	if err != nil {
+		return m, err
+	}
+
+	m.convo = append(m.convo[:idx:idx], msg)
+	if m.tree != nil {
+		m.tree.Replace(idx, msg)
+	}
+	return m, m.save()
+}
+
+// RegenerateAction drops the last reply and asks the same question again,
+// leaving the previous reply around as a branch.
+type RegenerateAction struct{}
+
+func (x RegenerateAction) Exec(m model) (model, error) {
+	idx := m.convo.LastQuestion()
+	if idx < 0 {
+		return m, errors.New("no question to ask again")
+	}
+	m.resend = m.convo[idx].Content
+	m.convo = m.convo[:idx]
+	return m, nil
+}
+
+// UndoAction removes the last question and everything after it.
+type UndoAction struct{}
+
+func (x UndoAction) Exec(m model) (model, error) {
+	idx := m.convo.LastQuestion()
+	if idx < 0 {
+		return m, errors.New("nothing to undo")
+	}
+	m.convo = m.convo[:idx]
+	if m.tree != nil {
+		m.tree.Cut(m.convo)
+	}
+	return m, m.save()
+}
+
+// EditLastAction puts the last question back into the prompt. Sending
+// it forks a new branch from there.
+type EditLastAction struct{}
+
+func (x EditLastAction) Exec(m model) (model, error) {
+	idx := m.convo.LastQuestion()
+	if idx < 0 {
+		return m, errors.New("no question to edit")
+	}
+	m.prompt.SetValue(m.convo[idx].Content)
+	m.convo = m.convo[:idx]
+	return m, nil
+}
+
+// SetModelAction switches the model used from the next question on.
+type SetModelAction struct {
+	model gptModel
+}
+
+func (x SetModelAction) Exec(m model) (model, error) {
+	m.opts.model = x.model
+	return m, m.save()
+}
+
+// SetSystemAction replaces the system message, or adds one.
+type SetSystemAction struct {
+	content string
+}
+
+func (x SetSystemAction) Exec(m model) (model, error) {
+	msg := message{Role: roleSystem, Content: x.content}
+	if len(m.convo) > 0 && m.convo[0].Role == roleSystem && !m.convo[0].IsSummary() {
+		m.convo = append(conversation{msg}, m.convo[1:]...)
+		if m.tree != nil {
+			m.tree.Replace(0, msg)
+		}
+	} else {
+		m.convo = append(conversation{msg}, m.convo...)
+		if m.tree != nil {
+			m.tree.Set(m.convo)
+		}
+	}
+	return m, m.save()
+}
+
+// UsePersonaAction switches to the named persona, or to helping with
+// the topic when there is no such persona.
+type UsePersonaAction struct {
+	name string
+}
+
+func (x UsePersonaAction) Exec(m model) (model, error) {
+	personas, err := m.opts.getPersonas()
+	if err != nil {
+		return m, err
+	}
+	p := findPersona(x.name, personas)
+	m.opts = p.Apply(m.opts)
+	if m.convo.LastQuestion() < 0 {
+		// Nothing asked yet, so the examples can go in too
+		m.convo = p.Conversation()
+		if m.tree != nil {
+			m.tree.Cut(m.convo)
+		}
+		return m, m.save()
+	}
+	return SetSystemAction{content: p.System}.Exec(m)
+}
+
+// ShowParamsAction shows the model, system message and parameters in use.
+type ShowParamsAction struct{}
+
+func (x ShowParamsAction) Exec(m model) (model, error) {
+	settings := []string{"model=" + string(m.opts.model)}
+	if len(m.convo) > 0 && m.convo[0].Role == roleSystem && !m.convo[0].IsSummary() {
+		system := m.convo[0].Content
+		if runes := []rune(system); len(runes) > 40 {
+			system = string(runes[:40]) + "…"
+		}
+		settings = append(settings, "system="+strconv.Quote(system))
+	}
+	if params := m.opts.params.String(); params != "" {
+		settings = append(settings, params)
+	}
+	m.notice = strings.Join(settings, " ")
+	return m, nil
+}
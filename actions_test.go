@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func Test_parseAction_CopyGeneric(t *testing.T) {
 	want, _ := parseAction("copy")
@@ -95,3 +98,346 @@ func Test_parseAction_CopyAll(t *testing.T) {
 		})
 	}
 }
+
+func Test_EditSelectedAction_TruncatesConversationAndFillsPrompt(t *testing.T) {
+	m := bootChat(options{}, conversation{
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+		message{Role: roleUser, Content: "q2"},
+		message{Role: roleGpt, Content: "a2"},
+	})
+
+	m, err := SelectMessageAction{}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.mode != modeSelectMessage {
+		t.Error("expected message selection mode")
+	}
+	if len(m.list.Items()) != 2 {
+		t.Errorf("expected user messages only, got %d", len(m.list.Items()))
+	}
+
+	m, err = EditSelectedAction{}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.mode != modeChat {
+		t.Error("expected chat mode")
+	}
+	if len(m.convo) != 2 {
+		t.Errorf("expected conversation to be cut before the edited message: %#v", m.convo)
+	}
+	if m.prompt.Value() != "q2" {
+		t.Errorf("expected prompt to hold the edited message, got %q", m.prompt.Value())
+	}
+}
+
+func Test_SwitchBranchAction(t *testing.T) {
+	m := bootChat(options{}, conversation{
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+	})
+
+	if _, err := (SwitchBranchAction{delta: 1}).Exec(m); err == nil {
+		t.Error("expected error without branches")
+	}
+
+	m.convo = conversation{
+		message{Role: roleUser, Content: "q1, edited"},
+		message{Role: roleGpt, Content: "a1, edited"},
+	}
+	m.tree.Set(m.convo)
+
+	m, err := SwitchBranchAction{delta: 1}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.convo.Last() != "a1" {
+		t.Errorf("expected original branch, got %#v", m.convo)
+	}
+}
+
+func Test_parseAction_Branches(t *testing.T) {
+	suite := map[string]Action{
+		"bn":         SwitchBranchAction{delta: 1},
+		"nextbranch": SwitchBranchAction{delta: 1},
+		"bp":         SwitchBranchAction{delta: -1},
+		"prevbranch": SwitchBranchAction{delta: -1},
+		"fork":       SelectMessageAction{},
+		"sm":         SelectMessageAction{},
+	}
+	for test, want := range suite {
+		t.Run(test, func(t *testing.T) {
+			got, err := parseAction(test)
+			if err != nil {
+				t.Error(err)
+			}
+			if got != want {
+				t.Errorf("want %v (%T), got %v (%T)", want, want, got, got)
+			}
+		})
+	}
+}
+
+func Test_SetParamAction(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+
+	action, err := parseAction(":set temperature 0.2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if action != (SetParamAction{name: "temperature", value: "0.2"}) {
+		t.Errorf("unexpected action: %#v", action)
+	}
+
+	m, err = action.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.opts.params.Temperature == nil || *m.opts.params.Temperature != 0.2 {
+		t.Errorf("expected temperature to be set: %#v", m.opts.params)
+	}
+
+	if _, err := (SetParamAction{name: "temperature", value: "3"}).Exec(m); err == nil {
+		t.Error("expected out of range value to be refused")
+	}
+	if _, err := parseAction("set"); err == nil {
+		t.Error("expected error without parameter")
+	}
+}
+
+func Test_ChooseAnswerAction(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	answers := conversation{
+		message{Role: roleGpt, Content: "a1"},
+		message{Role: roleGpt, Content: "a2"},
+		message{Role: roleGpt, Content: "a3"},
+	}
+	m := bootChat(options{session: "choose"}, conversation{
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1", Alternatives: answers},
+	})
+
+	m, err := ChooseAnswerAction{delta: -1}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.convo.Last() != "a3" {
+		t.Errorf("expected to wrap around to the last answer, got %q", m.convo.Last())
+	}
+	if m.tree.Path().Last() != "a3" || m.tree.LastFork() != -1 {
+		t.Errorf("expected answer to be replaced in the tree without forking: %#v", m.tree.Path())
+	}
+
+	action, err := parseAction(":choose 2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if action != (ChooseAnswerAction{index: 2}) {
+		t.Errorf("unexpected action: %#v", action)
+	}
+	if m, err = action.Exec(m); err != nil || m.convo.Last() != "a2" {
+		t.Errorf("expected second answer, got %q (%v)", m.convo.Last(), err)
+	}
+}
+
+func Test_parseAction_History(t *testing.T) {
+	suite := map[string]Action{
+		"retry": RegenerateAction{},
+		"regen": RegenerateAction{},
+		"undo":  UndoAction{},
+		"edit":  EditLastAction{},
+	}
+	for test, want := range suite {
+		t.Run(test, func(t *testing.T) {
+			got, err := parseAction(":" + test)
+			if err != nil {
+				t.Error(err)
+			}
+			if got != want {
+				t.Errorf("want %v (%T), got %v (%T)", want, want, got, got)
+			}
+		})
+	}
+}
+
+func newHistoryTestChat(t *testing.T) model {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	return bootChat(options{session: "history"}, conversation{
+		message{Role: roleSystem, Content: "sys"},
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+		message{Role: roleUser, Content: "q2"},
+		message{Role: roleGpt, Content: "a2"},
+	})
+}
+
+func Test_RegenerateAction(t *testing.T) {
+	m, err := RegenerateAction{}.Exec(newHistoryTestChat(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.resend != "q2" || len(m.convo) != 3 {
+		t.Errorf("expected last question to be asked again, got %q and %#v", m.resend, m.convo)
+	}
+
+	if _, err := (RegenerateAction{}).Exec(bootChat(options{}, conversation{})); err == nil {
+		t.Error("expected error without questions")
+	}
+}
+
+func Test_UndoAction(t *testing.T) {
+	m, err := UndoAction{}.Exec(newHistoryTestChat(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.convo) != 3 || m.convo.Last() != "a1" {
+		t.Errorf("expected last exchange to be removed, got %#v", m.convo)
+	}
+	if path := m.tree.Path(); len(path) != 3 {
+		t.Errorf("expected tree path to end at the undone exchange, got %#v", path)
+	}
+
+	s, err := loadSession("history")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(s.Messages) != 3 {
+		t.Errorf("expected undo to be saved, got %#v", s.Messages)
+	}
+}
+
+func Test_EditLastAction(t *testing.T) {
+	m, err := EditLastAction{}.Exec(newHistoryTestChat(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.prompt.Value() != "q2" || len(m.convo) != 3 {
+		t.Errorf("expected last question in the prompt, got %q and %#v", m.prompt.Value(), m.convo)
+	}
+}
+
+func Test_parseAction_Settings(t *testing.T) {
+	suite := map[string]Action{
+		":model gpt-4":       SetModelAction{model: gpt4},
+		":system Be brief.":  SetSystemAction{content: "Be brief."},
+		":prompt php":        UsePersonaAction{name: "php"},
+		":params":            ShowParamsAction{},
+		":model":             nil,
+		":system":            nil,
+		":prompt":            nil,
+		":choose 2":          ChooseAnswerAction{index: 2},
+		":set temperature 1": SetParamAction{name: "temperature", value: "1"},
+		":undo":              UndoAction{},
+		":bn":                SwitchBranchAction{delta: 1},
+	}
+	for test, want := range suite {
+		t.Run(test, func(t *testing.T) {
+			got, err := parseAction(test)
+			if want == nil {
+				if err == nil {
+					t.Errorf("expected usage error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			if got != want {
+				t.Errorf("want %v (%T), got %v (%T)", want, want, got, got)
+			}
+		})
+	}
+}
+
+func Test_SetModelAction(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	m := bootChat(options{model: gpt3, session: "settings"}, conversation{})
+
+	m, err := SetModelAction{model: gpt4}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.opts.model != gpt4 {
+		t.Errorf("expected model to be switched, got %q", m.opts.model)
+	}
+	m.setStatus(statusAwaitingInput)
+	if !strings.Contains(m.statusLine, string(gpt4)) {
+		t.Errorf("expected model in the status line: %q", m.statusLine)
+	}
+	if s, err := loadSession("settings"); err != nil || s.Model != gpt4 {
+		t.Errorf("expected model to be saved with the session, got %q (%v)", s.Model, err)
+	}
+}
+
+func Test_SetSystemAction(t *testing.T) {
+	m := bootChat(options{}, conversation{
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+	})
+
+	m, err := SetSystemAction{content: "first"}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.convo) != 3 || m.convo[0].Content != "first" {
+		t.Errorf("expected system message to be added, got %#v", m.convo)
+	}
+
+	m, err = SetSystemAction{content: "second"}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.convo) != 3 || m.convo[0].Content != "second" {
+		t.Errorf("expected system message to be replaced, got %#v", m.convo)
+	}
+	if path := m.tree.Path(); path[0].Content != "second" || len(path) != 3 {
+		t.Errorf("expected tree to follow, got %#v", path)
+	}
+}
+
+func Test_ShowParamsAction(t *testing.T) {
+	temperature := 0.5
+	m := bootChat(options{model: gpt4, params: gptParams{Temperature: &temperature}}, conversation{
+		message{Role: roleSystem, Content: "Be brief."},
+	})
+
+	m, err := ShowParamsAction{}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := `model=gpt-4 system="Be brief." temperature=0.5`; m.notice != want {
+		t.Errorf("want %q, got %q", want, m.notice)
+	}
+}
+
+func Test_UsePersonaAction(t *testing.T) {
+	personas := map[string]Persona{
+		"sql": {
+			System:   "You write SQL.",
+			Model:    gpt4,
+			Examples: conversation{message{Role: roleUser, Content: "q"}, message{Role: roleGpt, Content: "a"}},
+		},
+	}
+	m := bootChat(options{model: gpt3, personas: func() (map[string]Persona, error) { return personas, nil }}, conversation{
+		message{Role: roleSystem, Content: "sys"},
+	})
+
+	m, err := UsePersonaAction{name: "sql"}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.convo) != 3 || m.convo[0].Content != "You write SQL." || m.opts.model != gpt4 {
+		t.Errorf("expected persona with examples in a fresh conversation, got %#v", m.convo)
+	}
+
+	m.convo = append(m.convo, message{Role: roleUser, Content: "more"}, message{Role: roleGpt, Content: "ok"})
+	m, err = UsePersonaAction{name: "go"}.Exec(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.convo) != 5 || m.convo[0].Content != "You are a helpful assistant that helps with go." {
+		t.Errorf("expected only the system message to change, got %#v", m.convo)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAuth          = errors.New("authentication failed")
+	ErrRateLimit     = errors.New("rate limit exceeded")
+	ErrContextLength = errors.New("context length exceeded")
+	ErrServer        = errors.New("server error")
+)
+
+// APIError is a non-OK response from the chat completions endpoint.
+type APIError struct {
+	Status    int
+	RequestID string
+	Message   string
+	Type      string
+	Code      string
+
+	RetryAfter time.Duration
+}
+
+func (x *APIError) Error() string {
+	var msg strings.Builder
+	if kind := x.kind(); kind != nil {
+		msg.WriteString(kind.Error())
+	} else {
+		msg.WriteString("API error")
+	}
+	msg.WriteString(fmt.Sprintf(" (HTTP %d)", x.Status))
+	if x.Message != "" {
+		msg.WriteString(": ")
+		msg.WriteString(x.Message)
+	}
+	if hint := x.hint(); hint != "" {
+		msg.WriteString(" - ")
+		msg.WriteString(hint)
+	}
+	if x.RequestID != "" {
+		msg.WriteString(fmt.Sprintf(" [request %s]", x.RequestID))
+	}
+	return msg.String()
+}
+
+func (x *APIError) Is(target error) bool {
+	return target != nil && x.kind() == target
+}
+
+func (x *APIError) kind() error {
+	switch {
+	case x.Status == http.StatusUnauthorized, x.Status == http.StatusForbidden:
+		return ErrAuth
+	case x.Status == http.StatusTooManyRequests:
+		return ErrRateLimit
+	case x.Code == "context_length_exceeded":
+		return ErrContextLength
+	case x.Status >= http.StatusInternalServerError:
+		return ErrServer
+	}
+	return nil
+}
+
+func (x *APIError) hint() string {
+	switch x.kind() {
+	case ErrAuth:
+		path, _ := getConfigFilepath()
+		return fmt.Sprintf("check the token in %s", path)
+	case ErrRateLimit:
+		return "wait a bit before retrying, or check your plan and quota"
+	case ErrContextLength:
+		return "start a new conversation or shorten the prompt"
+	case ErrServer:
+		return "the API is having trouble, try again later"
+	}
+	return ""
+}
+
+func parseAPIError(resp *http.Response) error {
+	x := &APIError{
+		Status:    resp.StatusCode,
+		RequestID: resp.Header.Get("X-Request-Id"),
+
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return x
+	}
+
+	var payload struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    any    `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		x.Message = strings.TrimSpace(string(body))
+		return x
+	}
+
+	x.Message = payload.Error.Message
+	x.Type = payload.Error.Type
+	if payload.Error.Code != nil {
+		x.Code = fmt.Sprint(payload.Error.Code)
+	}
+	return x
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_parseAPIError(t *testing.T) {
+	suite := map[string]struct {
+		status int
+		body   string
+		want   error
+	}{
+		"auth": {
+			status: http.StatusUnauthorized,
+			body:   `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`,
+			want:   ErrAuth,
+		},
+		"rate limit": {
+			status: http.StatusTooManyRequests,
+			body:   `{"error":{"message":"Rate limit reached","type":"requests","code":null}}`,
+			want:   ErrRateLimit,
+		},
+		"context length": {
+			status: http.StatusBadRequest,
+			body:   `{"error":{"message":"This model's maximum context length is 4097 tokens","type":"invalid_request_error","code":"context_length_exceeded"}}`,
+			want:   ErrContextLength,
+		},
+		"server": {
+			status: http.StatusBadGateway,
+			body:   `<html>Bad gateway</html>`,
+			want:   ErrServer,
+		},
+	}
+	for name, test := range suite {
+		t.Run(name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: test.status,
+				Header:     http.Header{"X-Request-Id": []string{"req_123"}},
+				Body:       io.NopCloser(strings.NewReader(test.body)),
+			}
+			err := parseAPIError(resp)
+			if !errors.Is(err, test.want) {
+				t.Errorf("want %v, got %v", test.want, err)
+			}
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected API error, got %T", err)
+			}
+			if apiErr.Status != test.status {
+				t.Errorf("unexpected status: %d", apiErr.Status)
+			}
+			if apiErr.RequestID != "req_123" {
+				t.Errorf("unexpected request ID: %q", apiErr.RequestID)
+			}
+			if !strings.Contains(err.Error(), "req_123") {
+				t.Errorf("expected request ID in message: %q", err.Error())
+			}
+		})
+	}
+}
+
+func Test_APIError_UnknownKind(t *testing.T) {
+	err := &APIError{Status: http.StatusBadRequest, Message: "Invalid value for 'model'"}
+	for _, kind := range []error{ErrAuth, ErrRateLimit, ErrContextLength, ErrServer} {
+		if errors.Is(err, kind) {
+			t.Errorf("did not expect %v", kind)
+		}
+	}
+	if !strings.Contains(err.Error(), "Invalid value for 'model'") {
+		t.Errorf("expected API message in error: %q", err.Error())
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultAttachTokens   int   = 8000
+	defaultAttachFileSize int64 = 256 * 1024
+)
+
+type AttachmentsConfig struct {
+	MaxTokens   int   `json:",omitempty"` // For all attachments of a question together
+	MaxFileSize int64 `json:",omitempty"` // Bytes
+}
+
+type attachPolicy struct {
+	maxTokens   int
+	maxFileSize int64
+}
+
+func newAttachPolicy(cfg AttachmentsConfig) attachPolicy {
+	x := attachPolicy{
+		maxTokens:   defaultAttachTokens,
+		maxFileSize: defaultAttachFileSize,
+	}
+	if cfg.MaxTokens > 0 {
+		x.maxTokens = cfg.MaxTokens
+	}
+	if cfg.MaxFileSize > 0 {
+		x.maxFileSize = cfg.MaxFileSize
+	}
+	return x
+}
+
+var attachPattern = regexp.MustCompile(`(^|\s)@(\S+)`)
+
+var languages = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".ts": "typescript",
+	".tsx": "tsx", ".jsx": "jsx", ".rb": "ruby", ".rs": "rust", ".java": "java",
+	".kt": "kotlin", ".c": "c", ".h": "c", ".cpp": "cpp", ".hpp": "cpp",
+	".cs": "csharp", ".php": "php", ".sh": "bash", ".bash": "bash",
+	".sql": "sql", ".html": "html", ".css": "css", ".json": "json",
+	".yaml": "yaml", ".yml": "yaml", ".toml": "toml", ".xml": "xml",
+	".md": "markdown", ".swift": "swift", ".lua": "lua", ".mod": "go",
+}
+
+// expand turns @path references in the text into fenced code blocks
+// appended to it. References to nothing that exists are left alone,
+// as are files that are binary or too large, which get a warning.
+// Once a file does not fit in what is left of the token limit, the
+// rest are not even looked for.
+func (x attachPolicy) expand(text string) (string, []string) {
+	if x == (attachPolicy{}) {
+		x = newAttachPolicy(AttachmentsConfig{})
+	}
+	var (
+		blocks   strings.Builder
+		warnings []string
+		seen     = map[string]bool{}
+		tokens   = 0
+		full     = false
+	)
+	expanded := attachPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if full {
+			return match
+		}
+		lead, ref, _ := strings.Cut(match, "@")
+		found := findAttachments(ref, func(path string) bool {
+			if seen[path] {
+				return true
+			}
+			seen[path] = true
+			block, err := x.attach(path)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("skipped %s: %v", path, err))
+				return true
+			}
+			n := estimateTokens(block)
+			if tokens+n > x.maxTokens {
+				warnings = append(warnings, fmt.Sprintf("skipped %s and any further files: ~%d tokens would go over the limit of %d for attachments",
+					path, n, x.maxTokens))
+				full = true
+				return false
+			}
+			tokens += n
+			blocks.WriteString("\n\n")
+			blocks.WriteString(block)
+			return true
+		})
+		if !found {
+			return match
+		}
+		return lead + ref
+	})
+	return expanded + blocks.String(), warnings
+}
+
+// findAttachments calls visit with the files the reference names, trying
+// again without trailing punctuation if it names none. It reports whether
+// the reference named any.
+func findAttachments(ref string, visit func(path string) bool) bool {
+	for _, candidate := range []string{ref, strings.TrimRight(ref, `.,;:!?)"'`)} {
+		found := false
+		each := func(path string) bool {
+			found = true
+			return visit(path)
+		}
+		if strings.ContainsAny(candidate, "*?[") {
+			globFiles(candidate, each)
+		} else if _, err := os.Stat(candidate); err == nil {
+			walkFiles(candidate, each)
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// globFiles calls visit with the files matching the pattern, which may
+// use ** for any number of directories, until visit returns false. It
+// reports whether it went through all of them.
+func globFiles(pattern string, visit func(path string) bool) bool {
+	if !strings.Contains(pattern, "**") {
+		matches, _ := filepath.Glob(pattern)
+		for _, m := range matches {
+			if !walkFiles(m, visit) {
+				return false
+			}
+		}
+		return true
+	}
+
+	base := "."
+	if filepath.IsAbs(pattern) {
+		base = string(filepath.Separator)
+	}
+	static := true
+	afterSlash := true
+	var expr strings.Builder
+	expr.WriteString("^")
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(pattern)), "/")
+	for i, part := range parts {
+		static = static && !strings.ContainsAny(part, "*?[")
+		if static {
+			base = filepath.Join(base, part)
+		}
+		if !afterSlash {
+			expr.WriteString("/")
+		}
+		switch {
+		case part == "**" && i == len(parts)-1:
+			expr.WriteString(".*")
+		case part == "**":
+			expr.WriteString("(?:.*/)?")
+			afterSlash = true
+			continue
+		default:
+			expr.WriteString(globPart(part))
+		}
+		afterSlash = false
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return true
+	}
+
+	return walkFiles(base, func(path string) bool {
+		return !re.MatchString(filepath.ToSlash(path)) || visit(path)
+	})
+}
+
+func globPart(part string) string {
+	var out strings.Builder
+	for _, r := range part {
+		switch r {
+		case '*':
+			out.WriteString("[^/]*")
+		case '?':
+			out.WriteString("[^/]")
+		default:
+			out.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return out.String()
+}
+
+// walkFiles calls visit with the files under path, until visit returns
+// false. Hidden files and directories below path are skipped, and so is
+// whatever .gitignore files from the working directory down ignore. It
+// reports whether it went through all of them.
+func walkFiles(path string, visit func(path string) bool) bool {
+	ignore := gitignoreAbove(path)
+	done := true
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != path && (strings.HasPrefix(d.Name(), ".") || ignore.ignores(p, d.IsDir())) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			ignore = ignore.read(p)
+			return nil
+		}
+		if d.Type().IsRegular() && !visit(p) {
+			done = false
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return done
+}
+
+// gitignore holds the patterns of .gitignore files, each applying below
+// the directory it was found in. Patterns match with filepath.Match, so
+// ** only works as a leading **/.
+type gitignore []ignoreRule
+
+type ignoreRule struct {
+	dir      string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool // To the directory, rather than matching names at any depth
+}
+
+// gitignoreAbove reads the .gitignore files from the working directory
+// down to the one holding path, if path is within it.
+func gitignoreAbove(path string) gitignore {
+	x := gitignore{}
+	path = filepath.Clean(path)
+	if !filepath.IsLocal(path) || path == "." {
+		return x
+	}
+	dir := "."
+	for _, part := range strings.Split(path, string(filepath.Separator)) {
+		x = x.read(dir)
+		dir = filepath.Join(dir, part)
+	}
+	return x
+}
+
+// read adds the patterns of the .gitignore file in dir, if there is one.
+func (x gitignore) read(dir string) gitignore {
+	buf, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return x
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{dir: dir}
+		if rule.negate = strings.HasPrefix(line, "!"); rule.negate {
+			line = line[1:]
+		}
+		if rule.dirOnly = strings.HasSuffix(line, "/"); rule.dirOnly {
+			line = strings.TrimSuffix(line, "/")
+		}
+		line = strings.TrimPrefix(line, "**/")
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.TrimPrefix(line, "/")
+		if rule.pattern != "" {
+			x = append(x, rule)
+		}
+	}
+	return x
+}
+
+// ignores reports whether the last pattern matching the path ignores it.
+func (x gitignore) ignores(path string, isDir bool) bool {
+	ignored := false
+	for _, rule := range x {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(rule.dir, path)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		name := filepath.ToSlash(rel)
+		if !rule.anchored {
+			name = filepath.Base(rel)
+		}
+		if ok, _ := filepath.Match(rule.pattern, name); ok {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// attach renders the file as a fenced code block, if it is text.
+func (x attachPolicy) attach(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > x.maxFileSize {
+		return "", fmt.Errorf("larger than %d KiB", x.maxFileSize/1024)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if isBinary(buf) {
+		return "", errors.New("binary file")
+	}
+
+	fence := "```"
+	for bytes.Contains(buf, []byte(fence)) {
+		fence += "`"
+	}
+	return fmt.Sprintf("%s:\n%s%s\n%s\n%s", filepath.ToSlash(path), fence,
+		languages[strings.ToLower(filepath.Ext(path))], strings.TrimRight(string(buf), "\n"), fence), nil
+}
+
+func isBinary(buf []byte) bool {
+	head := buf
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	return bytes.IndexByte(head, 0) >= 0 || !utf8.Valid(buf)
+}
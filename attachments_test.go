@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func chdirTestAttachments(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"main.go":               "package main\n",
+		"README.md":             "# Title\n```sh\nmake\n```\n",
+		"internal/a/a.go":       "package a\n",
+		"internal/a/a_test.go":  "package a\n",
+		"internal/b/deep/b.go":  "package deep\n",
+		"internal/b/notes.txt":  "notes\n",
+		"internal/.hidden/h.go": "package hidden\n",
+		"internal/a/.env.go":    "package a\n",
+		"internal/a/debug.log":  "debug\n",
+		"internal/a/keep.log":   "keep\n",
+		"build/out.go":          "package main\n",
+		".env":                  "TOKEN=secret\n",
+		".gitignore":            "build/\n*.log\n!keep.log\n",
+		"assets/logo.png":       "\x89PNG\x00\x00",
+		"assets/big.txt":        strings.Repeat("word ", 1000),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(content), 0644)
+	}
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func Test_attachPolicy_expand(t *testing.T) {
+	chdirTestAttachments(t)
+
+	got, warnings := attachPolicy{}.expand("what does @main.go do?")
+	want := "what does main.go do?\n\nmain.go:\n```go\npackage main\n```"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	got, _ = attachPolicy{}.expand("see @README.md.")
+	if !strings.HasPrefix(got, "see README.md.\n\nREADME.md:\n````markdown\n# Title\n```sh") {
+		t.Errorf("expected a longer fence around nested code blocks: %q", got)
+	}
+
+	for _, text := range []string{"mail me@example.com", "ping @nobody", "@@ -1,3 +1,4 @@"} {
+		if got, warnings := (attachPolicy{}).expand(text); got != text || len(warnings) != 0 {
+			t.Errorf("expected %q to be left alone, got %q (%v)", text, got, warnings)
+		}
+	}
+}
+
+func Test_attachPolicy_expand_Globs(t *testing.T) {
+	chdirTestAttachments(t)
+
+	suite := map[string][]string{
+		"@internal/**/*.go": {"internal/a/a.go", "internal/a/a_test.go", "internal/b/deep/b.go"},
+		"@internal/*/a.go":  {"internal/a/a.go"},
+		"@internal/b":       {"internal/b/deep/b.go", "internal/b/notes.txt"},
+		"@internal/**":      {"internal/a/a.go", "internal/a/a_test.go", "internal/a/keep.log", "internal/b/deep/b.go", "internal/b/notes.txt"},
+		"@internal/a":       {"internal/a/a.go", "internal/a/a_test.go", "internal/a/keep.log"},
+	}
+	for ref, want := range suite {
+		t.Run(ref, func(t *testing.T) {
+			got, _ := attachPolicy{}.expand(ref)
+			attached := []string{}
+			for _, line := range strings.Split(got, "\n") {
+				if strings.HasPrefix(line, "internal/") && strings.HasSuffix(line, ":") {
+					attached = append(attached, strings.TrimSuffix(line, ":"))
+				}
+			}
+			if strings.Join(attached, " ") != strings.Join(want, " ") {
+				t.Errorf("want %v, got %v", want, attached)
+			}
+		})
+	}
+}
+
+func Test_attachPolicy_expand_Skips(t *testing.T) {
+	chdirTestAttachments(t)
+
+	got, warnings := attachPolicy{maxTokens: 100, maxFileSize: 1024}.expand("@assets @main.go")
+	if !strings.Contains(got, "main.go:\n```go") {
+		t.Errorf("expected small text file to be attached: %q", got)
+	}
+	if strings.Contains(got, "PNG") || strings.Contains(got, "word word") {
+		t.Errorf("expected binary and oversized files to be left out: %q", got)
+	}
+	if len(warnings) != 2 ||
+		!strings.Contains(warnings[0], "assets/big.txt: larger than 1 KiB") ||
+		!strings.Contains(warnings[1], "assets/logo.png: binary file") {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	_, warnings = attachPolicy{maxTokens: 10, maxFileSize: 1 << 20}.expand("@assets/big.txt")
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "limit of 10") {
+		t.Errorf("expected token limit warning, got %v", warnings)
+	}
+}
+
+func Test_attachPolicy_expand_SkipsHiddenAndIgnored(t *testing.T) {
+	chdirTestAttachments(t)
+
+	got, warnings := attachPolicy{}.expand("@.")
+	for _, unwanted := range []string{".env:", "build/out.go:", "debug.log:", ".env.go:", "h.go:", ".gitignore:"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("did not expect %s to be attached: %q", unwanted, got)
+		}
+	}
+	if !strings.Contains(got, "main.go:") || !strings.Contains(got, "internal/a/keep.log:") {
+		t.Errorf("expected the other files to be attached: %q", got)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "assets/logo.png: binary file") {
+		t.Errorf("expected a warning for the binary file only, got %v", warnings)
+	}
+
+	if got, _ := (attachPolicy{}).expand("@.env"); !strings.Contains(got, "TOKEN=secret") {
+		t.Errorf("expected a file asked for by name to be attached: %q", got)
+	}
+}
+
+func Test_attachPolicy_expand_StopsAtLimit(t *testing.T) {
+	chdirTestAttachments(t)
+
+	got, warnings := attachPolicy{maxTokens: 15, maxFileSize: 1024}.expand("@internal @main.go")
+	if !strings.Contains(got, "internal/a/a.go:") || strings.Contains(got, "a_test.go:") {
+		t.Errorf("expected only the first file to be attached: %q", got)
+	}
+	if !strings.HasPrefix(got, "internal @main.go\n") {
+		t.Errorf("expected later references to be left alone: %q", got)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "skipped internal/a/a_test.go and any further files") {
+		t.Errorf("expected a single warning, got %v", warnings)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+// chatNode is a message in the conversation tree. The root node holds
+// no message, and each node's selected child continues the current path.
+type chatNode struct {
+	Message  message     `json:"message"`
+	Children []*chatNode `json:"children,omitempty"`
+	Selected int         `json:"selected,omitempty"`
+}
+
+func newChatTree(c conversation) *chatNode {
+	root := &chatNode{}
+	root.Set(c)
+	return root
+}
+
+func (x *chatNode) selected() *chatNode {
+	if x.Selected < 0 || x.Selected >= len(x.Children) {
+		return nil
+	}
+	return x.Children[x.Selected]
+}
+
+// Path returns the conversation along the currently selected branches.
+func (x *chatNode) Path() conversation {
+	c := conversation{}
+	for node := x.selected(); node != nil; node = node.selected() {
+		c = append(c, node.Message)
+	}
+	return c
+}
+
+// Set makes c the current path, following existing branches where
+// messages match and forking a new branch where they diverge. Summaries
+// replace the messages they stand for in place.
+func (x *chatNode) Set(c conversation) {
+	node := x
+	for _, msg := range c {
+		next := -1
+		if current := node.selected(); current != nil && current.Message.same(msg) {
+			next = node.Selected
+		} else {
+			for idx, child := range node.Children {
+				if child.Message.same(msg) {
+					next = idx
+					break
+				}
+			}
+		}
+		if next < 0 && msg.IsSummary() && node.compact(msg) {
+			next = node.Selected
+		}
+		if next < 0 {
+			node.Children = append(node.Children, &chatNode{Message: msg})
+			next = len(node.Children) - 1
+		}
+		node.Selected = next
+		node = node.Children[next]
+	}
+}
+
+// compact swaps the messages following along the current path for the
+// summary of them, if that is what it summarizes, keeping their replies.
+func (x *chatNode) compact(summary message) bool {
+	originals := summary.Summarized
+	for node := x.selected(); node != nil; node = node.selected() {
+		covered := conversation{node.Message}
+		if node.Message.IsSummary() {
+			covered = node.Message.Summarized
+		}
+		if len(covered) > len(originals) {
+			return false
+		}
+		for i, msg := range covered {
+			if !msg.same(originals[i]) {
+				return false
+			}
+		}
+		if originals = originals[len(covered):]; len(originals) == 0 {
+			x.Children[x.Selected] = &chatNode{
+				Message:  summary,
+				Children: node.Children,
+				Selected: node.Selected,
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Cut makes c the current path, ending it there even where the last
+// message has replies. These are kept around as branches.
+func (x *chatNode) Cut(c conversation) {
+	x.Set(c)
+	if node := x.parent(len(c)); node != nil {
+		node.Selected = -1
+	}
+}
+
+// parent returns the node holding the alternatives for the message
+// at position idx in the current path.
+func (x *chatNode) parent(idx int) *chatNode {
+	node := x
+	for i := 0; i < idx && node != nil; i++ {
+		node = node.selected()
+	}
+	return node
+}
+
+// Branch reports which of the alternative branches is selected at
+// position idx of the current path, and how many there are.
+func (x *chatNode) Branch(idx int) (int, int) {
+	node := x.parent(idx)
+	if node == nil || len(node.Children) == 0 {
+		return 1, 1
+	}
+	return node.Selected + 1, len(node.Children)
+}
+
+// LastFork returns the position of the latest message in the current
+// path that has alternative branches, or -1 if there are none.
+func (x *chatNode) LastFork() int {
+	fork := -1
+	idx := 0
+	for node := x; node != nil; node = node.selected() {
+		if len(node.Children) > 1 {
+			fork = idx
+		}
+		idx++
+	}
+	return fork
+}
+
+// Cycle moves delta branches forward or back through the whole tree.
+// It switches at the latest fork of the current path, carrying over to
+// the earlier ones when that wraps around, so every branch is reached.
+func (x *chatNode) Cycle(delta int) conversation {
+	step := 1
+	if delta < 0 {
+		step, delta = -1, -delta
+	}
+	for ; delta > 0; delta-- {
+		forks := []*chatNode{}
+		for node := x; node != nil; node = node.selected() {
+			if len(node.Children) > 1 {
+				forks = append(forks, node)
+			}
+		}
+		for i := len(forks) - 1; i >= 0; i-- {
+			node := forks[i]
+			total := len(node.Children)
+			next := node.Selected + step
+			if node.Selected < 0 && step < 0 {
+				next = total - 1
+			}
+			node.Selected = (next%total + total) % total
+			if (next >= 0 && next < total) || i == 0 {
+				node.selected().rewind(step)
+				break
+			}
+		}
+	}
+	return x.Path()
+}
+
+// rewind selects the first branch at every fork below, or the last one
+// when going back.
+func (x *chatNode) rewind(step int) {
+	for node := x; node != nil; node = node.selected() {
+		if len(node.Children) > 1 {
+			node.Selected = 0
+			if step < 0 {
+				node.Selected = len(node.Children) - 1
+			}
+		}
+	}
+}
+
+// Replace swaps the message at position idx of the current path in place,
+// without forking a new branch.
+func (x *chatNode) Replace(idx int, msg message) {
+	if node := x.parent(idx); node != nil {
+		if current := node.selected(); current != nil {
+			current.Message = msg
+		}
+	}
+}
+
+func (x message) same(other message) bool {
+	return x.Role == other.Role &&
+		x.Content == other.Content &&
+		x.ToolCallID == other.ToolCallID &&
+		len(x.Summarized) == len(other.Summarized)
+}
@@ -0,0 +1,126 @@
+package main
+
+import "testing"
+
+func Test_chatNode_SetAndPath(t *testing.T) {
+	c := conversation{
+		message{Role: roleSystem, Content: "sys"},
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+	}
+	tree := newChatTree(c)
+
+	if got := tree.Path(); len(got) != 3 || got.Last() != "a1" {
+		t.Errorf("unexpected path: %#v", got)
+	}
+
+	tree.Set(append(c, message{Role: roleUser, Content: "q2"}))
+	if got := tree.Path(); len(got) != 4 || got.Last() != "q2" {
+		t.Errorf("expected path to be extended: %#v", got)
+	}
+	if fork := tree.LastFork(); fork != -1 {
+		t.Errorf("expected no forks, got %d", fork)
+	}
+}
+
+func Test_chatNode_ForksOnDivergence(t *testing.T) {
+	tree := newChatTree(conversation{
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+		message{Role: roleUser, Content: "q2"},
+		message{Role: roleGpt, Content: "a2"},
+	})
+
+	tree.Set(conversation{
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+		message{Role: roleUser, Content: "q2, edited"},
+		message{Role: roleGpt, Content: "a2, edited"},
+	})
+
+	if got := tree.Path(); got.Last() != "a2, edited" {
+		t.Errorf("expected new branch to be current: %#v", got)
+	}
+	if cur, total := tree.Branch(2); cur != 2 || total != 2 {
+		t.Errorf("want branch 2/2, got %d/%d", cur, total)
+	}
+	if cur, total := tree.Branch(1); cur != 1 || total != 1 {
+		t.Errorf("want branch 1/1, got %d/%d", cur, total)
+	}
+	if fork := tree.LastFork(); fork != 2 {
+		t.Errorf("expected fork at 2, got %d", fork)
+	}
+
+	if got := tree.Cycle(1); got.Last() != "a2" {
+		t.Errorf("expected switching to wrap to original branch: %#v", got)
+	}
+	if got := tree.Cycle(-1); got.Last() != "a2, edited" {
+		t.Errorf("expected switching back to the edited branch: %#v", got)
+	}
+}
+
+func Test_chatNode_Cycle_ReachesEarlierForks(t *testing.T) {
+	q1 := conversation{
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+		message{Role: roleUser, Content: "q2"},
+		message{Role: roleGpt, Content: "a2"},
+	}
+	tree := newChatTree(q1)
+	edited := conversation{
+		message{Role: roleUser, Content: "q1, edited"},
+		message{Role: roleGpt, Content: "a1, edited"},
+		message{Role: roleUser, Content: "q2, edited"},
+		message{Role: roleGpt, Content: "a2, edited"},
+	}
+	tree.Set(edited)
+	tree.Set(append(edited[:2:2],
+		message{Role: roleUser, Content: "q2, edited again"},
+		message{Role: roleGpt, Content: "a2, edited again"}))
+	if fork := tree.LastFork(); fork != 2 {
+		t.Fatalf("expected the latest fork at 2, got %d", fork)
+	}
+
+	for _, want := range []string{"a2", "a2, edited", "a2, edited again", "a2"} {
+		if got := tree.Cycle(1); got.Last() != want {
+			t.Errorf("want %q, got %#v", want, got)
+		}
+	}
+	for _, want := range []string{"a2, edited again", "a2, edited", "a2"} {
+		if got := tree.Cycle(-1); got.Last() != want {
+			t.Errorf("going back, want %q, got %#v", want, got)
+		}
+	}
+}
+
+func Test_chatNode_Set_ReplacesSummarizedMessages(t *testing.T) {
+	c := conversation{
+		message{Role: roleSystem, Content: "sys"},
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+		message{Role: roleUser, Content: "q2"},
+		message{Role: roleGpt, Content: "a2"},
+		message{Role: roleUser, Content: "q3"},
+		message{Role: roleGpt, Content: "a3"},
+	}
+	tree := newChatTree(c)
+
+	first := message{Role: roleSystem, Content: "summary 1", Summarized: c[1:5]}
+	compacted := conversation{c[0], first, c[5], c[6], message{Role: roleUser, Content: "q4"}}
+	tree.Set(compacted)
+	if got := tree.Path(); len(got) != 5 || !got[1].IsSummary() || got.Last() != "q4" {
+		t.Fatalf("expected summary in place of the messages: %#v", got)
+	}
+	if fork := tree.LastFork(); fork != -1 {
+		t.Errorf("expected summary not to fork a branch, got fork at %d", fork)
+	}
+
+	second := message{Role: roleSystem, Content: "summary 2", Summarized: append(c[1:5:5], c[5], c[6])}
+	tree.Set(conversation{c[0], second, compacted[4]})
+	if got := tree.Path(); len(got) != 3 || got[1].Content != "summary 2" {
+		t.Errorf("expected summary to replace the earlier one: %#v", got)
+	}
+	if fork := tree.LastFork(); fork != -1 {
+		t.Errorf("expected summary not to fork a branch, got fork at %d", fork)
+	}
+}
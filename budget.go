@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// estimatedCompletionTokens is assumed for responses when estimating
+// what a request will cost before sending it.
+const estimatedCompletionTokens int = 500
+
+var ErrBudget = errors.New("budget exceeded")
+
+type BudgetConfig struct {
+	Daily      float64 `json:",omitempty"` // Dollars
+	Monthly    float64 `json:",omitempty"` // Dollars
+	PerRequest float64 `json:",omitempty"` // Dollars
+}
+
+// BudgetError is returned when a request would go over a spending limit.
+type BudgetError struct {
+	Limit    string
+	Max      float64
+	Spent    float64
+	Estimate float64
+}
+
+func (x *BudgetError) Error() string {
+	if x.Limit == "per-request" {
+		return fmt.Sprintf("%s: request would cost ~$%.4f, %s limit is $%.2f",
+			ErrBudget, x.Estimate, x.Limit, x.Max)
+	}
+	return fmt.Sprintf("%s: spent $%.4f, request would cost ~$%.4f, %s limit is $%.2f",
+		ErrBudget, x.Spent, x.Estimate, x.Limit, x.Max)
+}
+
+func (x *BudgetError) Unwrap() error { return ErrBudget }
+
+type budgetPolicy struct {
+	daily      float64
+	monthly    float64
+	perRequest float64
+}
+
+func newBudgetPolicy(cfg BudgetConfig) budgetPolicy {
+	return budgetPolicy{
+		daily:      cfg.Daily,
+		monthly:    cfg.Monthly,
+		perRequest: cfg.PerRequest,
+	}
+}
+
+func (x budgetPolicy) enabled() bool {
+	return x.daily > 0 || x.monthly > 0 || x.perRequest > 0
+}
+
+// estimateCost guesses what sending the request will cost.
+func estimateCost(req gptMsg, prices map[gptModel]ModelPrice) float64 {
+	price, ok := priceOf(req.Model, prices)
+	if !ok {
+		return 0
+	}
+	completion := estimatedCompletionTokens
+	if req.MaxTokens != nil {
+		completion = *req.MaxTokens
+	}
+	if req.N != nil {
+		completion *= *req.N // Every answer is paid for
+	}
+	return price.Cost(req.Messages.Tokens(), completion)
+}
+
+// check refuses requests that would go over any of the spending limits.
+func (x budgetPolicy) check(req gptMsg, prices map[gptModel]ModelPrice, ledger usageLedger) error {
+	if !x.enabled() {
+		return nil
+	}
+	estimate := estimateCost(req, prices)
+	if x.perRequest > 0 && estimate > x.perRequest {
+		return &BudgetError{Limit: "per-request", Max: x.perRequest, Estimate: estimate}
+	}
+	if x.daily == 0 && x.monthly == 0 {
+		return nil
+	}
+
+	records, err := ledger.Records()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	var daily, monthly float64
+	for _, r := range records {
+		if !r.Time.Before(month) {
+			monthly += r.Cost
+		}
+		if !r.Time.Before(today) {
+			daily += r.Cost
+		}
+	}
+
+	if x.daily > 0 && daily+estimate > x.daily {
+		return &BudgetError{Limit: "daily", Max: x.daily, Spent: daily, Estimate: estimate}
+	}
+	if x.monthly > 0 && monthly+estimate > x.monthly {
+		return &BudgetError{Limit: "monthly", Max: x.monthly, Spent: monthly, Estimate: estimate}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newBudgetRequest(words int) gptMsg {
+	return gptMsg{Model: gpt4, Messages: conversation{
+		message{Role: roleUser, Content: strings.Repeat("word ", words)},
+	}}
+}
+
+func Test_budgetPolicy_check_PerRequest(t *testing.T) {
+	policy := budgetPolicy{perRequest: 0.05}
+	ledger := usageLedger{}
+
+	if err := policy.check(newBudgetRequest(10), nil, ledger); err != nil {
+		t.Errorf("expected small request to pass: %v", err)
+	}
+
+	err := policy.check(newBudgetRequest(2000), nil, ledger)
+	var budgetErr *BudgetError
+	if !errors.As(err, &budgetErr) || budgetErr.Limit != "per-request" {
+		t.Errorf("expected per-request budget error, got %v", err)
+	}
+	if !errors.Is(err, ErrBudget) {
+		t.Error("expected error to be a budget error")
+	}
+}
+
+func Test_budgetPolicy_check_Spent(t *testing.T) {
+	ledger := usageLedger{path: filepath.Join(t.TempDir(), usageLedgerFile)}
+	ledger.Record("", messageUsage{Model: gpt4, Cost: 0.99})
+
+	err := budgetPolicy{daily: 1}.check(newBudgetRequest(10), nil, ledger)
+	var budgetErr *BudgetError
+	if !errors.As(err, &budgetErr) || budgetErr.Limit != "daily" {
+		t.Fatalf("expected daily budget error, got %v", err)
+	}
+	if budgetErr.Spent != 0.99 {
+		t.Errorf("unexpected spent amount: %v", budgetErr.Spent)
+	}
+
+	err = budgetPolicy{monthly: 1}.check(newBudgetRequest(10), nil, ledger)
+	if !errors.As(err, &budgetErr) || budgetErr.Limit != "monthly" {
+		t.Errorf("expected monthly budget error, got %v", err)
+	}
+
+	if err := (budgetPolicy{daily: 10, monthly: 10}).check(newBudgetRequest(10), nil, ledger); err != nil {
+		t.Errorf("expected request to fit the budget: %v", err)
+	}
+}
+
+func Test_budgetPolicy_check_IgnoresOldSpend(t *testing.T) {
+	ledger := usageLedger{path: filepath.Join(t.TempDir(), usageLedgerFile)}
+	old, _ := json.Marshal(usageRecord{
+		Time:         time.Now().AddDate(0, -2, 0),
+		messageUsage: messageUsage{Model: gpt4, Cost: 5},
+	})
+	os.WriteFile(ledger.path, append(old, '\n'), 0600)
+
+	if err := (budgetPolicy{daily: 1, monthly: 1}).check(newBudgetRequest(10), nil, ledger); err != nil {
+		t.Errorf("expected spend from previous months to not count: %v", err)
+	}
+}
+
+func TestAsk_RefusesOverBudget(t *testing.T) {
+	p := newFakeProvider("hello")
+	opts := options{model: gpt4, provider: p, noCache: true, budget: budgetPolicy{perRequest: 0.0001}}
+
+	if _, err := (conversation{}).Ask(context.Background(), "hi", opts); !errors.Is(err, ErrBudget) {
+		t.Errorf("expected budget error, got %v", err)
+	}
+	if len(p.got) != 0 {
+		t.Error("expected request to not be sent")
+	}
+
+	opts.budgetConfirmed = true
+	if _, err := (conversation{}).Ask(context.Background(), "hi", opts); err != nil {
+		t.Errorf("expected confirmed request to be sent: %v", err)
+	}
+}
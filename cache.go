@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cacheScopeGlobal    string = "global"
+	cacheScopeSession   string = "session"
+	cacheScopeDirectory string = "directory"
+
+	defaultCacheTTL     time.Duration = 7 * 24 * time.Hour
+	defaultCacheMaxSize int64         = 50 * 1024 * 1024
+
+	cachePruneInterval time.Duration = 24 * time.Hour
+	cachePruneStamp    string        = ".pruned"
+)
+
+var errCacheDisabled = errors.New("cache disabled")
+
+type CacheConfig struct {
+	Disabled bool   `json:",omitempty"`
+	Scope    string `json:",omitempty"` // One of global, session or directory
+	TTL      int    `json:",omitempty"` // Seconds
+	MaxSize  int64  `json:",omitempty"` // Bytes
+}
+
+type cacheEntry struct {
+	Model    gptModel        `json:"model"`
+	Created  time.Time       `json:"created"`
+	Hash     string          `json:"hash"`
+	Response json.RawMessage `json:"response"`
+}
+
+type cacheStats struct {
+	Entries int
+	Expired int
+	Size    int64
+	Oldest  time.Time
+	Newest  time.Time
+}
+
+// responseCache keeps API responses in the user cache directory.
+type responseCache struct {
+	dir     string
+	ttl     time.Duration
+	maxSize int64
+}
+
+func newResponseCache(cfg CacheConfig) responseCache {
+	x := responseCache{
+		ttl:     defaultCacheTTL,
+		maxSize: defaultCacheMaxSize,
+	}
+	if cfg.TTL > 0 {
+		x.ttl = time.Duration(cfg.TTL) * time.Second
+	}
+	if cfg.MaxSize > 0 {
+		x.maxSize = cfg.MaxSize
+	}
+	return x
+}
+
+// cacheKey identifies a request by everything that affects the response,
+// including the endpoint it goes to, optionally namespaced so that
+// identical requests do not share answers.
+func cacheKey(req gptMsg, endpoint, namespace string) string {
+	req.Stream = false
+	req.StreamOptions = nil
+	h := md5.New()
+	json.NewEncoder(h).Encode(req)
+	io.WriteString(h, endpoint+"\n"+namespace)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func (x options) cacheNamespace() string {
+	switch x.cacheScope {
+	case cacheScopeSession:
+		return "session:" + x.session
+	case cacheScopeDirectory:
+		if cwd, err := os.Getwd(); err == nil {
+			return "directory:" + cwd
+		}
+	}
+	return ""
+}
+
+func (x options) fromCache(key string) ([]byte, error) {
+	if x.noCache || x.refresh {
+		return []byte{}, errCacheDisabled
+	}
+	entry, err := x.cache.Get(key)
+	if err != nil {
+		return []byte{}, err
+	}
+	return entry.Response, nil
+}
+
+func (x options) toCache(key string, req gptMsg, cnt []byte) error {
+	if x.noCache {
+		return errCacheDisabled
+	}
+	return x.cache.Put(key, req, cnt)
+}
+
+func getCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, configSourcePath), nil
+}
+
+func (x responseCache) getDir() (string, error) {
+	if x.dir != "" {
+		return x.dir, nil
+	}
+	return getCacheDir()
+}
+
+func (x responseCache) expired(entry cacheEntry) bool {
+	return x.ttl > 0 && time.Since(entry.Created) > x.ttl
+}
+
+func (x responseCache) Get(key string) (cacheEntry, error) {
+	var entry cacheEntry
+	dir, err := x.getDir()
+	if err != nil {
+		return entry, err
+	}
+
+	file := filepath.Join(dir, key+".json")
+	cnt, err := os.ReadFile(file)
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(cnt, &entry); err != nil {
+		return entry, err
+	}
+	if x.expired(entry) {
+		os.Remove(file)
+		return entry, os.ErrNotExist
+	}
+	return entry, nil
+}
+
+func (x responseCache) Put(key string, req gptMsg, cnt []byte) error {
+	dir, err := x.getDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	entry, err := json.Marshal(cacheEntry{
+		Model:    req.Model,
+		Created:  time.Now(),
+		Hash:     key,
+		Response: cnt,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, key+".json"), entry, 0600); err != nil {
+		return err
+	}
+	return x.pruneIfDue(dir)
+}
+
+// pruneIfDue prunes the cache at most once per interval, tracked by the
+// modification time of a stamp file. The first time around, it also
+// cleans up after earlier versions.
+func (x responseCache) pruneIfDue(dir string) error {
+	stamp := filepath.Join(dir, cachePruneStamp)
+	info, err := os.Stat(stamp)
+	switch {
+	case err == nil && time.Since(info.ModTime()) < cachePruneInterval:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		removeLegacyCache()
+		err = os.WriteFile(stamp, nil, 0600)
+	default:
+		now := time.Now()
+		err = os.Chtimes(stamp, now, now)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = x.Prune()
+	return err
+}
+
+type cacheFile struct {
+	path  string
+	size  int64
+	entry cacheEntry
+}
+
+func (x responseCache) files() ([]cacheFile, error) {
+	dir, err := x.getDir()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]cacheFile, 0, len(paths))
+	for _, path := range paths {
+		cnt, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		f := cacheFile{path: path, size: int64(len(cnt))}
+		json.Unmarshal(cnt, &f.entry)
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].entry.Created.Before(files[j].entry.Created)
+	})
+	return files, nil
+}
+
+func (x responseCache) Stats() (cacheStats, error) {
+	var stats cacheStats
+	files, err := x.files()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, f := range files {
+		stats.Entries++
+		stats.Size += f.size
+		if x.expired(f.entry) {
+			stats.Expired++
+		}
+	}
+	if len(files) > 0 {
+		stats.Oldest = files[0].entry.Created
+		stats.Newest = files[len(files)-1].entry.Created
+	}
+	return stats, nil
+}
+
+// Prune removes expired entries, then the oldest ones until the cache
+// fits its size limit. It returns the number of removed entries.
+func (x responseCache) Prune() (int, error) {
+	files, err := x.files()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+
+	removed := 0
+	for _, f := range files {
+		if !x.expired(f.entry) && (x.maxSize <= 0 || size <= x.maxSize) {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			return removed, err
+		}
+		size -= f.size
+		removed++
+	}
+	return removed, nil
+}
+
+func (x responseCache) Clear() (int, error) {
+	files, err := x.files()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := removeLegacyCache()
+	for _, f := range files {
+		if err := os.Remove(f.path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// removeLegacyCache cleans up responses cached into the temp dir by
+// earlier versions.
+func removeLegacyCache() int {
+	files, _ := filepath.Glob(filepath.Join(os.TempDir(), configSourcePath+"-*"))
+	removed := 0
+	for _, file := range files {
+		if len(strings.TrimPrefix(filepath.Base(file), configSourcePath+"-")) != md5.Size*2 {
+			continue
+		}
+		if os.Remove(file) == nil {
+			removed++
+		}
+	}
+	return removed
+}
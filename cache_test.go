@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFromCache(t *testing.T) {
+	cache := responseCache{dir: t.TempDir(), ttl: time.Hour}
+	req := gptMsg{Model: gpt3, Messages: conversation{
+		message{Role: roleUser, Content: "test data"},
+	}}
+	key := cacheKey(req, "", "")
+
+	testdata := []byte(`{"choices":[]}`)
+	if err := cache.Put(key, req, testdata); err != nil {
+		t.Fatalf("Error writing cache: %v", err)
+	}
+
+	stat, err := os.Stat(filepath.Join(cache.dir, key+".json"))
+	if err != nil {
+		t.Fatalf("Expected cache file: %v", err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("Expected private cache file, got %v", stat.Mode().Perm())
+	}
+
+	data, err := options{cache: cache}.fromCache(key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, testdata) {
+		t.Fatalf("Expected %s, but got %s", testdata, data)
+	}
+
+	entry, _ := cache.Get(key)
+	if entry.Model != gpt3 || entry.Hash != key || entry.Created.IsZero() {
+		t.Errorf("Expected entry metadata, got %#v", entry)
+	}
+}
+
+func Test_responseCache_ExpiresEntries(t *testing.T) {
+	cache := responseCache{dir: t.TempDir(), ttl: time.Hour}
+	writeCacheEntry(t, cache, "old", time.Now().Add(-2*time.Hour), 10)
+
+	if _, err := cache.Get("old"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected expired entry to be missing, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cache.dir, "old.json")); err == nil {
+		t.Error("expected expired entry to be removed")
+	}
+}
+
+func Test_responseCache_Prune(t *testing.T) {
+	cache := responseCache{dir: t.TempDir(), ttl: time.Hour}
+	writeCacheEntry(t, cache, "expired", time.Now().Add(-2*time.Hour), 10)
+	writeCacheEntry(t, cache, "oldest", time.Now().Add(-30*time.Minute), 100)
+	writeCacheEntry(t, cache, "newest", time.Now(), 100)
+
+	stats, _ := cache.Stats()
+	if stats.Entries != 3 || stats.Expired != 1 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+
+	size := stats.Size
+	newest, _ := os.Stat(filepath.Join(cache.dir, "newest.json"))
+	cache.maxSize = newest.Size()
+	if _, err := cache.Prune(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stats, _ = cache.Stats()
+	if stats.Entries != 1 || stats.Size >= size {
+		t.Errorf("expected expired and oldest entries to be evicted: %#v", stats)
+	}
+	if _, err := cache.Get("newest"); err != nil {
+		t.Errorf("expected newest entry to survive: %v", err)
+	}
+}
+
+func Test_responseCache_Put_PrunesOncePerInterval(t *testing.T) {
+	cache := responseCache{dir: t.TempDir(), ttl: time.Hour}
+	if err := cache.Put("first", gptMsg{}, []byte(`"x"`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	writeCacheEntry(t, cache, "expired", time.Now().Add(-2*time.Hour), 10)
+	if err := cache.Put("second", gptMsg{}, []byte(`"x"`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats, _ := cache.Stats(); stats.Expired != 1 {
+		t.Errorf("expected no prune until the interval passed: %#v", stats)
+	}
+
+	long := time.Now().Add(-2 * cachePruneInterval)
+	os.Chtimes(filepath.Join(cache.dir, cachePruneStamp), long, long)
+	if err := cache.Put("third", gptMsg{}, []byte(`"x"`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats, _ := cache.Stats(); stats.Expired != 0 || stats.Entries != 3 {
+		t.Errorf("expected expired entry to be pruned: %#v", stats)
+	}
+}
+
+func Test_responseCache_Clear(t *testing.T) {
+	cache := responseCache{dir: t.TempDir()}
+	writeCacheEntry(t, cache, "one", time.Now(), 10)
+	writeCacheEntry(t, cache, "two", time.Now(), 10)
+
+	if _, err := cache.Clear(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats, _ := cache.Stats(); stats.Entries != 0 {
+		t.Errorf("expected empty cache: %#v", stats)
+	}
+}
+
+func writeCacheEntry(t *testing.T, cache responseCache, key string, created time.Time, size int) {
+	cnt, _ := json.Marshal(cacheEntry{
+		Created:  created,
+		Hash:     key,
+		Response: json.RawMessage(`"` + strings.Repeat("x", size) + `"`),
+	})
+	if err := os.WriteFile(filepath.Join(cache.dir, key+".json"), cnt, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_cacheKey_CoversWholeRequest(t *testing.T) {
+	base := gptMsg{Model: gpt3, Messages: conversation{
+		message{Role: roleSystem, Content: "You help with bash"},
+		message{Role: roleUser, Content: "and in python?"},
+	}}
+	key := cacheKey(base, "", "")
+
+	otherModel := base
+	otherModel.Model = gpt4
+	if cacheKey(otherModel, "", "") == key {
+		t.Error("expected model to affect the cache key")
+	}
+
+	otherHistory := base
+	otherHistory.Messages = conversation{
+		message{Role: roleSystem, Content: "You help with php"},
+		message{Role: roleUser, Content: "and in python?"},
+	}
+	if cacheKey(otherHistory, "", "") == key {
+		t.Error("expected earlier messages to affect the cache key")
+	}
+
+	if cacheKey(base, "", "session:other") == key {
+		t.Error("expected namespace to affect the cache key")
+	}
+	if cacheKey(base, "http://localhost:8080/v1/", "") == key {
+		t.Error("expected endpoint to affect the cache key")
+	}
+
+	streamed := base
+	streamed.Stream = true
+	if cacheKey(streamed, "", "") != key {
+		t.Error("expected streaming to not affect the cache key")
+	}
+}
+
+func Test_options_cacheNamespace(t *testing.T) {
+	if ns := (options{}).cacheNamespace(); ns != "" {
+		t.Errorf("expected global scope by default, got %q", ns)
+	}
+	if ns := (options{cacheScope: cacheScopeSession, session: "wat"}).cacheNamespace(); ns != "session:wat" {
+		t.Errorf("unexpected session namespace: %q", ns)
+	}
+	if ns := (options{cacheScope: cacheScopeDirectory}).cacheNamespace(); ns == "" {
+		t.Error("expected directory namespace")
+	}
+}
+
+func TestAsk_NoCacheBypassesCache(t *testing.T) {
+	q := "no cache test"
+	cache := responseCache{dir: t.TempDir()}
+	req := gptMsg{Messages: conversation{message{Role: roleUser, Content: q}}}
+	cache.Put(cacheKey(req, options{}.endpoint(""), ""), req, []byte(`{"choices":[{"message":{"role":"assistant","content":"cached"}}]}`))
+
+	c, err := conversation{}.Ask(context.Background(), q, options{provider: newFakeProvider("fresh"), cache: cache})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Last() != "cached" {
+		t.Errorf("expected cached response, got %q", c.Last())
+	}
+
+	c, err = conversation{}.Ask(context.Background(), q, options{provider: newFakeProvider("fresh"), cache: cache, noCache: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Last() != "fresh" {
+		t.Errorf("expected fresh response, got %q", c.Last())
+	}
+}
+
+func Test_runCommand_Cache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	var out bytes.Buffer
+	ok, err := runCommand([]string{"cache", "stats"}, Config{}, &out)
+	if !ok || err != nil {
+		t.Fatalf("expected cache stats to run: %v, %v", ok, err)
+	}
+	if !strings.Contains(out.String(), "entries:") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+
+	if ok, _ := runCommand([]string{"cache", "me", "if", "you", "can"}, Config{}, &out); ok {
+		t.Error("expected regular question not to be treated as a command")
+	}
+}
+
+func TestOptionsSend_RefreshReplacesCachedResponse(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	req := gptMsg{Model: gpt3, Messages: conversation{message{Role: roleUser, Content: "q"}}}
+	p := newFakeProvider("new")
+	opts := options{provider: p, cache: responseCache{dir: t.TempDir(), ttl: time.Hour}}
+	stale, _ := json.Marshal(newFakeResponse("rejected"))
+	opts.cache.Put(cacheKey(req, opts.endpoint(""), opts.cacheNamespace()), req, stale)
+
+	refresh := opts
+	refresh.refresh = true
+	if raw, err := refresh.send(context.Background(), req, nil); err != nil || raw.Choices[0].Message.Content != "new" {
+		t.Fatalf("expected a fresh response, got %#v, %v", raw, err)
+	}
+	raw, err := opts.send(context.Background(), req, nil)
+	if err != nil || raw.Choices[0].Message.Content != "new" {
+		t.Errorf("expected the cached response to be replaced, got %#v, %v", raw, err)
+	}
+	if len(p.got) != 1 {
+		t.Errorf("expected the second request to be answered from the cache, got %d requests", len(p.got))
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -39,6 +41,7 @@ func bootChat(opts options, convo conversation) model {
 		mode:     modeChat,
 		opts:     opts,
 		convo:    convo,
+		tree:     newChatTree(convo),
 		prompt:   tx,
 		viewport: vp,
 		list:     ls,
@@ -48,8 +51,12 @@ func bootChat(opts options, convo conversation) model {
 	return m
 }
 
-func chat(opts options, convo conversation) {
+func chat(opts options, convo conversation, tree *chatNode) {
 	m := bootChat(opts, convo)
+	if tree != nil {
+		tree.Set(convo)
+		m.tree = tree
+	}
 	p := tea.NewProgram(m)
 	if _, err := p.Run(); err != nil {
 		log.Fatal(err)
@@ -62,6 +69,7 @@ const (
 	statusAwaitingInput systemStatus = iota
 	statusAwaitingResponse
 	statusAwaitingAction
+	statusAwaitingConfirmation
 )
 
 type renderMode uint8
@@ -69,13 +77,21 @@ type renderMode uint8
 const (
 	modeChat renderMode = iota
 	modeSelectCode
+	modeSelectMessage
 )
 
 type model struct {
 	mode renderMode
 
-	opts  options
-	convo conversation
+	opts     options
+	convo    conversation
+	inflight conversation
+	tree     *chatNode
+	cancel   context.CancelFunc
+	request  int // Identifies the latest request, responses to others are stale
+	approve  chan<- bool
+	resend   string // Question to ask again once an action is done
+	notice   string // Information an action wants shown
 
 	status     systemStatus
 	statusLine string
@@ -96,6 +112,16 @@ func (m *model) setStatus(s systemStatus) {
 	switch s {
 	case statusAwaitingInput:
 		m.statusLine = "Enter to send, Ctrl+D to quit"
+		if m.opts.model != "" {
+			m.statusLine += " · " + string(m.opts.model)
+		}
+		if usage := m.convo.UsageByModel(); len(usage) == 1 {
+			m.statusLine += fmt.Sprintf(" · %d tokens, $%.4f", usage[0].Tokens(), usage[0].Cost)
+		} else {
+			for _, u := range usage {
+				m.statusLine += fmt.Sprintf(" · %s: %d tokens, $%.4f", u.Model, u.Tokens(), u.Cost)
+			}
+		}
 		m.prompt.Prompt = "> "
 	case statusAwaitingResponse:
 		m.statusLine = "... Awaiting response ..."
@@ -103,6 +129,9 @@ func (m *model) setStatus(s systemStatus) {
 	case statusAwaitingAction:
 		m.statusLine = "Enter command"
 		m.prompt.Prompt = ""
+	case statusAwaitingConfirmation:
+		m.statusLine = "Send anyway? (y/n)"
+		m.prompt.Prompt = "? "
 	default:
 		m.statusLine = ""
 	}
@@ -146,7 +175,11 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if m.mode == modeChat {
 				if m.status == statusAwaitingAction {
 					m.setStatus(statusAwaitingInput)
-				} else if m.status != statusAwaitingResponse {
+				} else if m.status == statusAwaitingConfirmation {
+					m.confirm("n")
+				} else if m.status == statusAwaitingResponse {
+					m.cancelRequest()
+				} else {
 					m.setStatus(statusAwaitingAction)
 				}
 			} else {
@@ -157,6 +190,32 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			lsCmd = nil
 		case tea.KeyCtrlS:
 			myCmd = executeAction(actionSwitchToSelection, m)
+		case tea.KeyCtrlO:
+			myCmd = executeAction(actionSelectMessage, m)
+		case tea.KeyCtrlLeft:
+			myCmd = executeAction(actionPrevBranch, m)
+		case tea.KeyCtrlRight:
+			myCmd = executeAction(actionNextBranch, m)
+		case tea.KeyCtrlR:
+			if m.mode == modeChat && m.status == statusAwaitingInput {
+				myCmd = executeAction(actionRegenerate, m)
+			}
+		case tea.KeyCtrlZ:
+			if m.mode == modeChat && m.status == statusAwaitingInput {
+				myCmd = executeAction(actionUndo, m)
+			}
+		case tea.KeyCtrlG:
+			if m.mode == modeChat && m.status == statusAwaitingInput {
+				myCmd = executeAction(actionEdit, m)
+			}
+		case tea.KeyTab:
+			if m.mode == modeChat && m.hasAlternatives() {
+				myCmd = executeAction(actionNextAnswer, m)
+			}
+		case tea.KeyShiftTab:
+			if m.mode == modeChat && m.hasAlternatives() {
+				myCmd = executeAction(actionPrevAnswer, m)
+			}
 		case tea.KeyCtrlC:
 			if m.mode == modeSelectCode {
 				myCmd = executeAction(actionCopySelected, m)
@@ -169,9 +228,13 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case tea.KeyEnter:
 			if m.mode == modeSelectCode {
 				myCmd = executeAction(actionCopySelected, m)
+			} else if m.mode == modeSelectMessage {
+				myCmd = executeAction(actionEditSelected, m)
 			} else {
 				currentPrompt := m.prompt.Value()
-				if currentPrompt != "" {
+				if m.status == statusAwaitingConfirmation {
+					myCmd = m.confirm(currentPrompt)
+				} else if currentPrompt != "" {
 					m.prompt.Placeholder = currentPrompt
 					m.prompt.Reset()
 					m.prompt.Blur()
@@ -180,8 +243,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					}
 					switch m.status {
 					case statusAwaitingInput:
-						m.setStatus(statusAwaitingResponse)
-						myCmd = fetchResponse(currentPrompt, m)
+						myCmd = m.send(currentPrompt)
 					case statusAwaitingAction:
 						myCmd = executeAction(currentPrompt, m)
 					}
@@ -191,11 +253,73 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		}
 	case refresh:
-		m.viewport.SetContent(renderMessages(m.convo, m.width))
+		m.viewport.SetContent(renderMessages(m.visible(), m.width, m.tree))
 		m.viewport.GotoBottom()
+	case progress:
+		x, cmd := m.Update(msg.msg)
+		return x, tea.Batch(cmd, waitForProgress(msg.stream))
+	case attached:
+		if msg.request != m.request {
+			break
+		}
+		if len(m.inflight) > 0 {
+			m.inflight[0].Content = msg.question
+			myCmd = updateViewport
+		}
+		if len(msg.warnings) > 0 {
+			m.setStatusMsg(strings.Join(msg.warnings, "; "))
+		}
+	case streamDelta:
+		if msg.request != m.request {
+			break
+		}
+		if len(m.inflight) > 0 {
+			m.inflight[len(m.inflight)-1].Content += msg.content
+		}
+		myCmd = updateViewport
+	case retrying:
+		if msg.request != m.request {
+			break
+		}
+		m.setStatusMsg(fmt.Sprintf("retrying (%d/%d)…", msg.attempt, msg.max))
+	case toolApproval:
+		if msg.request != m.request {
+			msg.reply <- false
+			break
+		}
+		m.approve = msg.reply
+		m.setStatus(statusAwaitingConfirmation)
+		m.setStatusMsg(fmt.Sprintf("Run %s? (y/n)", msg.call))
+		m.prompt.Focus()
 	case response:
+		if msg.request != m.request || errors.Is(msg.err, context.Canceled) {
+			break // Cancelled or superseded, already handled by cancelRequest
+		}
+		m.cancel = nil
 		m.convo = msg.convo
+		m.inflight = nil
+		if m.tree != nil {
+			m.tree.Set(m.convo)
+		}
+		if errors.Is(msg.err, ErrBudget) {
+			m.setStatus(statusAwaitingConfirmation)
+			m.setStatusMsg(msg.err.Error() + " - send anyway? (y/n)")
+			m.prompt.Focus()
+			break
+		}
 		m.setStatus(statusAwaitingInput)
+		if msg.err != nil {
+			m.setStatusMsg(msg.err.Error())
+			if !errors.Is(msg.err, ErrIncomplete) {
+				m.prompt.SetValue(m.prompt.Placeholder)
+			} else if err := m.save(); err != nil {
+				m.setStatusMsg(err.Error())
+			}
+		} else if err := m.save(); err != nil {
+			m.setStatusMsg(err.Error())
+		} else if warning := m.opts.window.warning(m.convo, m.opts.model); warning != "" {
+			m.setStatusMsg(warning)
+		}
 		m.prompt.Placeholder = ""
 		m.prompt.Focus()
 		myCmd = updateViewport
@@ -204,6 +328,16 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		if msg.err != nil {
 			m.setStatusMsg(msg.err.Error())
 			cmd = switchToAfter(statusAwaitingInput, 2)
+		} else if msg.model.notice != "" {
+			m = msg.model
+			m.setStatusMsg(m.notice)
+			m.notice = ""
+			cmd = switchToAfter(statusAwaitingInput, 5)
+		} else if msg.model.resend != "" {
+			m = msg.model
+			question := m.resend
+			m.resend = ""
+			cmd = m.resendUncached(question)
 		} else {
 			m = msg.model
 			cmd = switchToAfter(statusAwaitingInput, 0)
@@ -218,6 +352,121 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, tea.Batch(txCmd, vpCmd, myCmd, lsCmd)
 }
 
+// send asks the question in the background, and awaits the response.
+func (m *model) send(prompt string) tea.Cmd {
+	m.setStatus(statusAwaitingResponse)
+	var ctx context.Context
+	ctx, m.cancel = context.WithCancel(context.Background())
+	m.request++
+	cmd := fetchResponse(ctx, prompt, *m)
+	if m.opts.stream {
+		m.inflight = conversation{
+			message{Role: roleUser, Content: prompt},
+			message{Role: roleGpt},
+		}
+		cmd = tea.Batch(cmd, updateViewport)
+	}
+	return cmd
+}
+
+// resendUncached asks the question again, ignoring any cached response
+// and caching the new one in its place.
+func (m *model) resendUncached(question string) tea.Cmd {
+	m.prompt.Reset()
+	m.prompt.Placeholder = question
+	m.prompt.Blur()
+	m.opts.refresh = true
+	cmd := m.send(question)
+	m.opts.refresh = false
+	return cmd
+}
+
+// confirm resends the question that went over budget if the answer
+// is yes, or puts it back into the prompt otherwise.
+func (m *model) confirm(answer string) tea.Cmd {
+	if m.approve != nil {
+		return m.approveTool(answer)
+	}
+	question := m.prompt.Placeholder
+	m.prompt.Reset()
+	m.prompt.Placeholder = ""
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		m.prompt.Placeholder = question
+		m.prompt.Blur()
+		m.opts.budgetConfirmed = true
+		cmd := m.send(question)
+		m.opts.budgetConfirmed = false
+		return cmd
+	}
+	m.prompt.SetValue(question)
+	m.setStatus(statusAwaitingInput)
+	return nil
+}
+
+// approveTool lets the pending tool call run if the answer is yes.
+func (m *model) approveTool(answer string) tea.Cmd {
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		m.approve <- true
+	default:
+		m.approve <- false
+	}
+	m.approve = nil
+	m.prompt.Reset()
+	m.prompt.Blur()
+	m.setStatus(statusAwaitingResponse)
+	return nil
+}
+
+// cancelRequest aborts the in-flight request, if any, and puts
+// the question back into the prompt.
+func (m *model) cancelRequest() {
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+	m.cancel = nil
+	m.request++
+	m.inflight = nil
+	m.approve = nil
+
+	m.prompt.SetValue(m.prompt.Placeholder)
+	m.prompt.Placeholder = ""
+	m.prompt.Focus()
+	m.setStatus(statusAwaitingInput)
+}
+
+// save persists the conversation into the current session, if there is one.
+func (m model) save() error {
+	if m.opts.session == "" {
+		return nil
+	}
+	return saveSession(session{
+		Name:     m.opts.session,
+		Messages: m.convo,
+		Tree:     m.tree,
+		Params:   &m.opts.params,
+		Model:    m.opts.model,
+	})
+}
+
+// visible returns the conversation to render, including any
+// response that is still being streamed in.
+func (m model) visible() conversation {
+	if len(m.inflight) == 0 {
+		return m.convo
+	}
+	c := make(conversation, 0, len(m.convo)+len(m.inflight))
+	c = append(c, m.convo...)
+	return append(c, m.inflight...)
+}
+
+// hasAlternatives reports whether there are other answers to choose from.
+func (m model) hasAlternatives() bool {
+	return len(m.convo) > 0 && len(m.convo[len(m.convo)-1].Alternatives) > 1
+}
+
 func (m *model) setMode(mode renderMode) {
 	m.mode = mode
 }
@@ -226,8 +475,8 @@ func (m model) View() string {
 	switch m.mode {
 	case modeChat:
 		return m.viewChat()
-	case modeSelectCode:
-		return m.viewCodeSelection()
+	case modeSelectCode, modeSelectMessage:
+		return m.viewListSelection()
 	}
 	return ""
 }
@@ -242,7 +491,7 @@ func (m model) viewPrompt() string {
 		Render(m.statusLine) + "\n" + prompt
 }
 
-func (m model) viewCodeSelection() string {
+func (m model) viewListSelection() string {
 	return fmt.Sprintf(
 		"%s\n%s",
 		m.list.View(),
@@ -258,7 +507,7 @@ func (m model) viewChat() string {
 	) + "\n\n"
 }
 
-func renderMessages(convo conversation, width int) string {
+func renderMessages(convo conversation, width int, tree *chatNode) string {
 	box := lipgloss.NewStyle().Width(width)
 	system := box.Copy().
 		Width(width - 8).
@@ -273,9 +522,13 @@ func renderMessages(convo conversation, width int) string {
 		Width(width - 8).
 		Align(lipgloss.Left)
 	gptHeader := gpt.Copy().Foreground(lipgloss.Color("#3498DB"))
+	summary := system.Copy().Faint(true).Italic(true)
+	summaryHeader := summary.Copy().Foreground(lipgloss.Color("#9B59B6"))
+	tool := gpt.Copy().Faint(true)
+	toolHeader := tool.Copy().Foreground(lipgloss.Color("#E67E22"))
 
 	out := new(strings.Builder)
-	for _, msg := range convo {
+	for idx, msg := range convo {
 		headerStyle := lipgloss.NewStyle()
 		style := lipgloss.NewStyle()
 		switch msg.Role {
@@ -288,6 +541,9 @@ func renderMessages(convo conversation, width int) string {
 		case roleGpt:
 			headerStyle = gptHeader
 			style = gpt
+		case roleTool:
+			headerStyle = toolHeader
+			style = tool
 		}
 
 		var render string
@@ -307,9 +563,30 @@ func renderMessages(convo conversation, width int) string {
 		} else {
 			render = msg.Content
 		}
+		for _, c := range msg.ToolCalls {
+			render = strings.TrimSpace(render + "\n→ " + c.String())
+		}
+
+		header := string(msg.Role)
+		if msg.IsSummary() {
+			headerStyle = summaryHeader
+			style = summary
+			header = fmt.Sprintf("summary of %d messages", len(msg.Summarized))
+		}
+		if len(msg.Alternatives) > 1 {
+			header += fmt.Sprintf(" (answer %d/%d, Tab for next)", msg.Choice+1, len(msg.Alternatives))
+		}
+		if note := msg.FinishNote(); note != "" {
+			header += " [" + note + "]"
+		}
+		if tree != nil {
+			if current, total := tree.Branch(idx); total > 1 {
+				header += fmt.Sprintf(" (branch %d/%d)", current, total)
+			}
+		}
 
 		out.WriteString(lipgloss.JoinVertical(lipgloss.Left,
-			headerStyle.Render(string(msg.Role)),
+			headerStyle.Render(header),
 			style.Render(render)))
 		out.WriteString("\n")
 
@@ -318,19 +595,98 @@ func renderMessages(convo conversation, width int) string {
 	return out.String()
 }
 
-func fetchResponse(prompt string, m model) tea.Cmd {
-	return func() tea.Msg {
-		if c, err := m.convo.Ask(prompt, m.opts); err != nil {
-			c := append(c, message{Role: roleGpt, Content: err.Error()})
-			return response{convo: c}
+func fetchResponse(ctx context.Context, prompt string, m model) tea.Cmd {
+	request := m.request
+	return inBackground(func(notify func(tea.Msg)) tea.Msg {
+		opts := m.opts
+		opts.onRetry = func(attempt, max int, err error) {
+			notify(retrying{request: request, attempt: attempt, max: max})
+		}
+		question, warnings := opts.attach.expand(prompt)
+		if question != prompt || len(warnings) > 0 {
+			notify(attached{request: request, question: question, warnings: warnings})
+		}
+		opts.approveTool = func(ctx context.Context, call toolCall) bool {
+			reply := make(chan bool, 1)
+			notify(toolApproval{request: request, call: call, reply: reply})
+			select {
+			case ok := <-reply:
+				return ok
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var (
+			c   conversation
+			err error
+		)
+		if opts.stream {
+			c, err = m.convo.Stream(ctx, question, opts, func(delta string) {
+				notify(streamDelta{request: request, content: delta})
+			})
 		} else {
-			return response{convo: c}
+			c, err = m.convo.Ask(ctx, question, opts)
 		}
-	}
+		return response{request: request, convo: c, err: err}
+	})
 }
 
 type response struct {
-	convo conversation
+	request int
+	convo   conversation
+	err     error
+}
+
+// attached holds the question with the files it refers to attached.
+type attached struct {
+	request  int
+	question string
+	warnings []string
+}
+
+type streamDelta struct {
+	request int
+	content string
+}
+
+type retrying struct {
+	request      int
+	attempt, max int
+}
+
+// toolApproval asks whether the tool call may run, awaiting the reply.
+type toolApproval struct {
+	request int
+	call    toolCall
+	reply   chan<- bool
+}
+
+// progress wraps an intermediate message sent by a background command,
+// so that the model keeps listening for more until the final one.
+type progress struct {
+	msg    tea.Msg
+	stream <-chan tea.Msg
+}
+
+func inBackground(fn func(notify func(tea.Msg)) tea.Msg) tea.Cmd {
+	return func() tea.Msg {
+		stream := make(chan tea.Msg)
+		go func() {
+			defer close(stream)
+			result := fn(func(msg tea.Msg) {
+				stream <- progress{msg: msg, stream: stream}
+			})
+			stream <- result
+		}()
+		return <-stream
+	}
+}
+
+func waitForProgress(stream <-chan tea.Msg) tea.Cmd {
+	return func() tea.Msg {
+		return <-stream
+	}
 }
 
 func updateViewport() tea.Msg {
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
@@ -185,6 +188,26 @@ func Test_modelUpdate_KeyMsg_CtrlS_SwitchesToSelection(t *testing.T) {
 	}
 }
 
+func Test_modelUpdate_KeyMsg_Tab_ChoosesAnswerOnlyWithAlternatives(t *testing.T) {
+	key := tea.Key{Type: tea.KeyTab}
+	m := bootChat(options{}, conversation{message{Role: roleGpt, Content: "only"}})
+
+	if _, cmd := m.Update(tea.KeyMsg(key)); cmd != nil {
+		t.Errorf("tab should do nothing without alternatives: %#v", cmd)
+	}
+
+	answers := conversation{message{Role: roleGpt, Content: "one"}, message{Role: roleGpt, Content: "two"}}
+	m = bootChat(options{}, conversation{message{Role: roleGpt, Content: "one", Alternatives: answers}})
+	_, cmd := m.Update(tea.KeyMsg(key))
+	x := cmd().(tea.BatchMsg)
+	if len(x) != 1 {
+		t.Fatalf("want one msg, got %#v", x)
+	}
+	if y, ok := x[0]().(executionResult); !ok || y.model.convo.Last() != "two" {
+		t.Errorf("expected tab to switch to the next answer: %#v", y)
+	}
+}
+
 func Test_modelUpdate_KeyMsg_CtrlC_CopiesFromSelectionInSelectMode(t *testing.T) {
 	m := bootChat(options{}, conversation{})
 	key := tea.Key{Type: tea.KeyCtrlC}
@@ -347,3 +370,349 @@ func Test_modelUpdate_executionResult_UpdatesModelOnSuccess(t *testing.T) {
 		t.Error("expected model update")
 	}
 }
+
+func Test_modelUpdate_streamDelta_UpdatesInflightResponse(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+	m.inflight = conversation{
+		message{Role: roleUser, Content: "wat"},
+		message{Role: roleGpt},
+	}
+	stream := make(chan tea.Msg)
+
+	x, cmd := m.Update(tea.Msg(progress{msg: streamDelta{content: "he"}, stream: stream}))
+	m, _ = x.(model)
+	x, _ = m.Update(tea.Msg(progress{msg: streamDelta{content: "llo"}, stream: stream}))
+	m, _ = x.(model)
+
+	if cmd == nil {
+		t.Error("expected command waiting for the rest of the stream")
+	}
+	if m.inflight[1].Content != "hello" {
+		t.Errorf("unexpected inflight content: %q", m.inflight[1].Content)
+	}
+	if len(m.visible()) != 2 {
+		t.Errorf("expected inflight messages to be visible: %#v", m.visible())
+	}
+
+	x, _ = m.Update(tea.Msg(response{convo: m.visible()}))
+	m, _ = x.(model)
+	if m.inflight != nil {
+		t.Error("expected response to clear inflight messages")
+	}
+	if len(m.convo) != 2 {
+		t.Errorf("expected convo update: %#v", m.convo)
+	}
+}
+
+func Test_modelUpdate_attached_ShowsExpandedQuestion(t *testing.T) {
+	m := bootChat(options{stream: true, provider: newFakeProvider("ok"), noCache: true}, conversation{})
+	m.send("what is in @nothing/here")
+	if m.inflight[0].Content != "what is in @nothing/here" {
+		t.Errorf("expected the question as typed until attachments are read: %q", m.inflight[0].Content)
+	}
+
+	x, _ := m.Update(tea.Msg(attached{request: m.request, question: "what is in nothing/here", warnings: []string{"skipped it"}}))
+	m, _ = x.(model)
+	if m.inflight[0].Content != "what is in nothing/here" {
+		t.Errorf("expected the question with attachments, got %q", m.inflight[0].Content)
+	}
+	if m.statusLine != "skipped it" {
+		t.Errorf("expected warnings in the status line, got %q", m.statusLine)
+	}
+}
+
+func Test_modelUpdate_response_SetsStatusMsgOnError(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+	err := &APIError{Status: 401, Message: "Incorrect API key provided"}
+
+	m.setStatus(statusAwaitingResponse)
+	x, _ := m.Update(tea.Msg(response{convo: conversation{}, err: err}))
+	m, _ = x.(model)
+
+	if m.status != statusAwaitingInput {
+		t.Error("expected awaiting input status")
+	}
+	if m.statusLine != err.Error() {
+		t.Errorf("expected error in status line, got %q", m.statusLine)
+	}
+	if len(m.convo) != 0 {
+		t.Errorf("expected error to stay out of the conversation: %#v", m.convo)
+	}
+}
+
+func Test_modelUpdate_response_KeepsIncompleteAnswer(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+	m.setStatus(statusAwaitingResponse)
+	m.prompt.Placeholder = "q"
+	c := conversation{
+		message{Role: roleUser, Content: "q"},
+		message{Role: roleGpt, Content: "part one", Finish: gptFinishLength},
+	}
+
+	x, _ := m.Update(tea.Msg(response{convo: c, err: ErrIncomplete}))
+	m, _ = x.(model)
+
+	if len(m.convo) != 2 || m.statusLine != ErrIncomplete.Error() {
+		t.Errorf("expected partial answer with the error, got %q: %#v", m.statusLine, m.convo)
+	}
+	if m.prompt.Value() != "" {
+		t.Errorf("expected question to not be put back, got %q", m.prompt.Value())
+	}
+}
+
+func Test_modelUpdate_retrying_SetsStatusMsg(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+	m.setStatus(statusAwaitingResponse)
+
+	x, _ := m.Update(tea.Msg(retrying{attempt: 2, max: 5}))
+	m, _ = x.(model)
+
+	if m.statusLine != "retrying (2/5)…" {
+		t.Errorf("unexpected status line: %q", m.statusLine)
+	}
+	if m.status != statusAwaitingResponse {
+		t.Error("expected to still be awaiting response")
+	}
+}
+
+func Test_modelUpdate_KeyMsg_KeyEsc_CancelsInflightRequest(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+	cancelled := false
+	m.cancel = func() { cancelled = true }
+	m.setStatus(statusAwaitingResponse)
+	m.prompt.Placeholder = "what was the question"
+	m.inflight = conversation{message{Role: roleUser, Content: "what was the question"}}
+
+	x, _ := m.Update(tea.KeyMsg(tea.Key{Type: tea.KeyEsc}))
+	m, _ = x.(model)
+
+	if !cancelled {
+		t.Error("expected request to be cancelled")
+	}
+	if m.status != statusAwaitingInput {
+		t.Errorf("expected awaiting input status, got %v", m.status)
+	}
+	if m.prompt.Value() != "what was the question" {
+		t.Errorf("expected prompt to be restored, got %q", m.prompt.Value())
+	}
+	if m.inflight != nil {
+		t.Error("expected inflight messages to be dropped")
+	}
+
+	x, _ = m.Update(tea.Msg(response{convo: conversation{}, err: context.Canceled}))
+	m, _ = x.(model)
+	if len(m.convo) != 0 {
+		t.Errorf("expected cancelled response to leave convo alone: %#v", m.convo)
+	}
+	if m.prompt.Value() != "what was the question" {
+		t.Errorf("expected prompt to survive cancelled response, got %q", m.prompt.Value())
+	}
+}
+
+func Test_modelUpdate_KeyEsc_CancelsDuringBackoff(t *testing.T) {
+	p := &fakeProvider{err: &APIError{Status: 429, Message: "slow down", RetryAfter: time.Minute}}
+	m := bootChat(options{provider: p, retry: retryPolicy{maxAttempts: 3}}, conversation{})
+	m.prompt.Placeholder = "first question"
+	cmd := m.send("first question")
+
+	prog, ok := cmd().(progress)
+	if !ok {
+		t.Fatal("expected the retry to be reported before the response")
+	}
+	x, _ := m.Update(tea.Msg(prog))
+	m, _ = x.(model)
+	x, _ = m.Update(tea.KeyMsg(tea.Key{Type: tea.KeyEsc}))
+	m, _ = x.(model)
+	if m.prompt.Value() != "first question" {
+		t.Fatalf("expected prompt to be restored, got %q", m.prompt.Value())
+	}
+
+	m.prompt.Reset()
+	m.prompt.Placeholder = "second question"
+	m.send("second question")
+	status := m.statusLine
+
+	final := (<-prog.stream).(response)
+	if !errors.Is(final.err, context.Canceled) {
+		t.Errorf("expected the cancelled request to end with context.Canceled, got %v", final.err)
+	}
+	for _, stale := range []response{final, {request: final.request, err: p.err}} {
+		x, _ = m.Update(tea.Msg(stale))
+		m, _ = x.(model)
+		if m.status != statusAwaitingResponse || m.statusLine != status {
+			t.Errorf("expected stale response to be dropped, got status %q", m.statusLine)
+		}
+		if m.prompt.Placeholder != "second question" {
+			t.Errorf("expected pending question to be kept, got %q", m.prompt.Placeholder)
+		}
+	}
+}
+
+func Test_modelUpdate_response_SavesSession(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	m := bootChat(options{session: "autosave"}, conversation{})
+	c1 := conversation{
+		message{Role: roleUser, Content: "hi"},
+		message{Role: roleGpt, Content: "hello"},
+	}
+
+	m.setStatus(statusAwaitingResponse)
+	m.Update(tea.Msg(response{convo: c1}))
+
+	s, err := loadSession("autosave")
+	if err != nil {
+		t.Fatalf("expected session to be saved: %v", err)
+	}
+	if len(s.Messages) != len(c1) {
+		t.Errorf("unexpected saved messages: %#v", s.Messages)
+	}
+}
+
+func Test_modelUpdate_response_ForksBranch(t *testing.T) {
+	m := bootChat(options{}, conversation{
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+	})
+	m.convo = conversation{}
+
+	m.setStatus(statusAwaitingResponse)
+	x, _ := m.Update(tea.Msg(response{convo: conversation{
+		message{Role: roleUser, Content: "q1, edited"},
+		message{Role: roleGpt, Content: "a1, edited"},
+	}}))
+	m, _ = x.(model)
+
+	if current, total := m.tree.Branch(0); current != 2 || total != 2 {
+		t.Errorf("want branch 2/2, got %d/%d", current, total)
+	}
+	if !strings.Contains(renderMessages(m.convo, 80, m.tree), "branch 2/2") {
+		t.Error("expected branch to be indicated in rendered messages")
+	}
+}
+
+func Test_setStatus_ShowsUsage(t *testing.T) {
+	m := bootChat(options{}, conversation{
+		message{Role: roleGpt, Content: "hi", Usage: &messageUsage{PromptTokens: 10, CompletionTokens: 20, Cost: 0.25}},
+	})
+	m.setStatus(statusAwaitingInput)
+	if !strings.Contains(m.statusLine, "30 tokens, $0.2500") {
+		t.Errorf("expected usage in status line: %q", m.statusLine)
+	}
+
+	m.convo = append(m.convo,
+		message{Role: roleGpt, Content: "hi", Usage: &messageUsage{Model: gpt4, PromptTokens: 5, CompletionTokens: 5, Cost: 0.5}},
+		message{Role: roleGpt, Content: "hi", Usage: &messageUsage{Model: gpt3, PromptTokens: 1, CompletionTokens: 2, Cost: 0.25}})
+	m.convo[0].Usage.Model = gpt3
+	m.setStatus(statusAwaitingInput)
+	if !strings.Contains(m.statusLine, " · gpt-3.5-turbo: 33 tokens, $0.5000 · gpt-4: 10 tokens, $0.5000") {
+		t.Errorf("expected usage per model in status line: %q", m.statusLine)
+	}
+}
+
+func Test_modelUpdate_response_AsksForBudgetConfirmation(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+	m.setStatus(statusAwaitingResponse)
+	m.prompt.Placeholder = "expensive question"
+
+	x, _ := m.Update(tea.Msg(response{convo: conversation{}, err: &BudgetError{Limit: "daily", Max: 1}}))
+	m, _ = x.(model)
+	if m.status != statusAwaitingConfirmation {
+		t.Fatalf("expected confirmation status, got %v", m.status)
+	}
+	if !strings.Contains(m.statusLine, "send anyway") {
+		t.Errorf("expected confirmation question in status line: %q", m.statusLine)
+	}
+
+	m.prompt.SetValue("n")
+	x, cmd := m.Update(tea.KeyMsg(tea.Key{Type: tea.KeyEnter}))
+	m, _ = x.(model)
+	if m.status != statusAwaitingInput {
+		t.Errorf("expected declining to return to input, got %v", m.status)
+	}
+	if m.prompt.Value() != "expensive question" {
+		t.Errorf("expected question back in prompt, got %q", m.prompt.Value())
+	}
+	if cmd != nil {
+		t.Errorf("expected no command when declining: %#v", cmd)
+	}
+}
+
+func Test_modelUpdate_KeyMsg_Enter_ConfirmsBudget(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+	m.setStatus(statusAwaitingConfirmation)
+	m.prompt.Placeholder = "expensive question"
+	m.prompt.SetValue("y")
+
+	x, cmd := m.Update(tea.KeyMsg(tea.Key{Type: tea.KeyEnter}))
+	m, _ = x.(model)
+	if m.status != statusAwaitingResponse {
+		t.Errorf("expected confirming to send the question, got %v", m.status)
+	}
+	if m.opts.budgetConfirmed {
+		t.Error("expected confirmation to apply to a single request")
+	}
+	if cmd == nil {
+		t.Error("expected command fetching the response")
+	}
+}
+
+func TestRenderMessages_MarksTruncated(t *testing.T) {
+	convo := conversation{
+		message{Role: roleGpt, Content: "partial", Finish: gptFinishFlt},
+	}
+	if out := renderMessages(convo, 80, nil); !strings.Contains(out, "[filtered]") {
+		t.Errorf("expected filtered marker in %q", out)
+	}
+}
+
+func Test_modelUpdate_toolApproval(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+	m.setStatus(statusAwaitingResponse)
+	m.prompt.Placeholder = "question"
+
+	reply := make(chan bool, 1)
+	call := toolCall{ID: "call_1", Function: toolCallFunction{Name: "read_file", Arguments: `{"path":"go.mod"}`}}
+	x, _ := m.Update(tea.Msg(toolApproval{call: call, reply: reply}))
+	m, _ = x.(model)
+	if m.status != statusAwaitingConfirmation {
+		t.Fatalf("expected confirmation status, got %v", m.status)
+	}
+	if !strings.Contains(m.statusLine, "read_file") {
+		t.Errorf("expected tool call in status line: %q", m.statusLine)
+	}
+
+	m.prompt.SetValue("y")
+	x, _ = m.Update(tea.KeyMsg(tea.Key{Type: tea.KeyEnter}))
+	m, _ = x.(model)
+	if ok := <-reply; !ok {
+		t.Error("expected tool call to be approved")
+	}
+	if m.status != statusAwaitingResponse || m.approve != nil {
+		t.Errorf("expected to go back to awaiting the response, got %v", m.status)
+	}
+	if m.prompt.Placeholder != "question" {
+		t.Errorf("expected question to be kept, got %q", m.prompt.Placeholder)
+	}
+}
+
+func Test_modelUpdate_executionResult_Resends(t *testing.T) {
+	m := bootChat(options{}, conversation{})
+	done := m
+	done.resend = "again"
+
+	x, cmd := m.Update(tea.Msg(executionResult{model: done}))
+	m, _ = x.(model)
+	if m.status != statusAwaitingResponse {
+		t.Errorf("expected question to be sent again, got %v", m.status)
+	}
+	if m.resend != "" || m.prompt.Placeholder != "again" {
+		t.Errorf("unexpected state: %q, %q", m.resend, m.prompt.Placeholder)
+	}
+	if m.opts.refresh || m.opts.noCache {
+		t.Error("expected cache bypass to apply to a single request")
+	}
+	if cmd == nil {
+		t.Error("expected command fetching the response")
+	}
+}
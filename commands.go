@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// runCommand handles gptcli subcommands, such as `gptcli cache stats`.
+// It reports whether args were recognized as one.
+func runCommand(args []string, cfg Config, out io.Writer) (bool, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return false, nil
+	}
+	switch args[0] {
+	case "cache":
+		if len(args) != 2 {
+			return false, nil
+		}
+		switch args[1] {
+		case "stats", "clear", "prune":
+			return true, cacheCommand(args[1], newResponseCache(cfg.Cache), out)
+		}
+	case "usage":
+		if len(args) > 2 {
+			return false, nil
+		}
+		if len(args) == 1 {
+			return true, usageCommand("day", newUsageLedger(), out)
+		}
+		switch args[1] {
+		case "day", "model", "session":
+			return true, usageCommand(args[1], newUsageLedger(), out)
+		}
+	case "personas":
+		if len(args) == 1 || (args[1] != "list" && args[1] != "show") || (args[1] == "list" && len(args) != 2) {
+			return false, nil
+		}
+		personas, err := loadPersonas(cfg)
+		if err != nil {
+			return true, err
+		}
+		return true, personasCommand(args[1:], personas, out)
+	}
+	return false, nil
+}
+
+func cacheCommand(cmd string, cache responseCache, out io.Writer) error {
+	switch cmd {
+	case "stats":
+		stats, err := cache.Stats()
+		if err != nil {
+			return err
+		}
+		dir, _ := cache.getDir()
+		fmt.Fprintf(out, "directory:\t%s\n", dir)
+		fmt.Fprintf(out, "entries:\t%d (%d expired)\n", stats.Entries, stats.Expired)
+		fmt.Fprintf(out, "size:\t\t%.1f KiB (limit %.1f KiB)\n",
+			float64(stats.Size)/1024, float64(cache.maxSize)/1024)
+		if stats.Entries > 0 {
+			fmt.Fprintf(out, "oldest:\t\t%s\n", stats.Oldest.Format("2006-01-02 15:04"))
+			fmt.Fprintf(out, "newest:\t\t%s\n", stats.Newest.Format("2006-01-02 15:04"))
+		}
+	case "clear":
+		removed, err := cache.Clear()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "removed %d cached responses\n", removed)
+	case "prune":
+		removed, err := cache.Prune()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "pruned %d cached responses\n", removed)
+	}
+	return nil
+}
@@ -10,13 +10,32 @@ import (
 const (
 	configSourcePath string = "gptcli"
 	configSourceFile string = "config.json"
+
+	envBaseURL string = "GPTCLI_BASE_URL"
 )
 
 var ErrConfig = errors.New("configuration error")
 
 type Config struct {
-	Token string
-	Model gptModel
+	Token        string
+	Model        gptModel
+	Stream       bool
+	StreamUsage  *bool             `json:",omitempty"` // Usage of streamed responses, asked from OpenAI only by default
+	BaseURL      string            `json:",omitempty"`
+	Organization string            `json:",omitempty"`
+	Headers      map[string]string `json:",omitempty"`
+	Retry        RetryConfig
+	Timeout      int `json:",omitempty"` // Seconds
+	Cache        CacheConfig
+	Context      ContextConfig
+	Summary      SummaryConfig
+	Prices       map[gptModel]ModelPrice `json:",omitempty"`
+	Budget       BudgetConfig
+	Params       gptParams
+	AutoContinue int `json:",omitempty"` // Continuations of truncated answers
+	Tools        ToolsConfig
+	Personas     map[string]Persona `json:",omitempty"`
+	Attachments  AttachmentsConfig
 }
 
 func hasConfigFile() bool {
@@ -33,15 +52,15 @@ func hasConfigFile() bool {
 func loadConfig() Config {
 	var config Config
 
-	cfgFile, err := getConfigFilepath()
-	if err != nil {
-		return config
+	if cfgFile, err := getConfigFilepath(); err == nil {
+		if file, err := os.Open(cfgFile); err == nil {
+			json.NewDecoder(file).Decode(&config)
+			file.Close()
+		}
 	}
 
-	if file, err := os.Open(cfgFile); err != nil {
-		return config
-	} else if err := json.NewDecoder(file).Decode(&config); err != nil {
-		return config
+	if url := os.Getenv(envBaseURL); url != "" {
+		config.BaseURL = url
 	}
 
 	return config
@@ -108,3 +108,13 @@ func Test_Initialize(t *testing.T) {
 		}
 	})
 }
+
+func Test_loadConfig_BaseURLFromEnv(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv(envBaseURL, "http://localhost:8080/v1")
+
+	cfg := loadConfig()
+	if cfg.BaseURL != "http://localhost:8080/v1" {
+		t.Errorf("expected env override, got %q", cfg.BaseURL)
+	}
+}
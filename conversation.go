@@ -1,21 +1,32 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
-	"path"
 	"strings"
 )
 
 type message struct {
 	Role    role   `json:"role"`
 	Content string `json:"content"`
+
+	// ToolCalls are the tools the assistant asked to run, and ToolCallID
+	// the call a tool message holds the result of
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+
+	// Summarized holds the original messages replaced by this summary
+	Summarized conversation `json:"summarized,omitempty"`
+
+	// Alternatives holds every answer when several were asked for,
+	// and Choice which of them the message currently is
+	Alternatives conversation `json:"alternatives,omitempty"`
+	Choice       int          `json:"choice,omitempty"`
+
+	Usage  *messageUsage   `json:"usage,omitempty"`
+	Finish gptFinishReason `json:"finish_reason,omitempty"`
 }
 
 type role string
@@ -24,6 +35,7 @@ const (
 	roleSystem role = "system"
 	roleUser   role = "user"
 	roleGpt    role = "assistant"
+	roleTool   role = "tool"
 )
 
 type conversation []message
@@ -39,6 +51,19 @@ func (x conversation) ParseCode() []string {
 	return code
 }
 
+// stripped returns the conversation with just the fields the API accepts.
+func (x conversation) stripped() conversation {
+	c := make(conversation, 0, len(x))
+	for _, m := range x {
+		c = append(c, message{
+			Role:       m.Role,
+			Content:    m.Content,
+			ToolCalls:  m.ToolCalls,
+			ToolCallID: m.ToolCallID})
+	}
+	return c
+}
+
 func (x conversation) Last() string {
 	if len(x) == 0 {
 		return ""
@@ -46,66 +71,225 @@ func (x conversation) Last() string {
 	return x[len(x)-1].Content
 }
 
-func (x conversation) Ask(q string, opts options) (conversation, error) {
-	if opts.token == "" {
-		return x, errors.New("missing token")
+// LastQuestion returns the position of the latest user message, or -1.
+func (x conversation) LastQuestion() int {
+	for i := len(x) - 1; i >= 0; i-- {
+		if x[i].Role == roleUser {
+			return i
+		}
+	}
+	return -1
+}
+
+func (x conversation) Ask(ctx context.Context, q string, opts options) (conversation, error) {
+	return x.ask(ctx, q, opts, nil)
+}
+
+func (x conversation) Stream(ctx context.Context, q string, opts options, out func(string)) (conversation, error) {
+	return x.ask(ctx, q, opts, out)
+}
+
+func (x conversation) ask(ctx context.Context, q string, opts options, out func(string)) (conversation, error) {
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
+	if opts.summary.due(x, opts) {
+		compacted, err := x.compact(ctx, opts)
+		if err != nil {
+			return x, err
+		}
+		x = compacted
 	}
+
 	query := make(conversation, 0, len(x)+2)
 	query = append(query, x...)
 	query = append(query, message{Role: roleUser, Content: q})
 
-	var content []byte
-	if fc, err := fromCache(q); err != nil {
-		mdl := gptMsg{
-			Model:    opts.model,
-			Messages: query}
-		body, err := json.Marshal(mdl)
-		if err != nil {
-			return x, err
+	payload, err := opts.window.fit(query, opts.model)
+	if err != nil {
+		return x, err
+	}
+	if opts.instructions != "" {
+		last := len(payload) - 1
+		payload = append(payload[:last:last],
+			message{Role: roleSystem, Content: opts.instructions},
+			payload[last])
+	}
+
+	if err := opts.params.Validate(); err != nil {
+		return x, err
+	}
+	req := gptMsg{
+		Model:     opts.model,
+		Messages:  payload.stripped(),
+		Tools:     opts.tools.definitions(),
+		gptParams: opts.params}
+	if opts.jsonMode {
+		req.ResponseFormat = &gptResponseFormat{Type: "json_object"}
+	}
+
+	raw, err := opts.send(ctx, req, out)
+	if err != nil {
+		return x, err
+	}
+	usage := opts.recordUsage(raw)
+
+	for round := 0; len(raw.Choices) > 0 && len(raw.Choices[0].Message.ToolCalls) > 0; round++ {
+		if round >= opts.tools.maxRounds() {
+			return x, fmt.Errorf("no answer after %d rounds of tool calls", round)
 		}
+		calls := raw.Choices[0].Message
+		results := conversation{message{Role: calls.Role, Content: calls.Content, ToolCalls: calls.ToolCalls}}
+		for _, c := range calls.ToolCalls {
+			results = append(results, opts.runTool(ctx, c))
+		}
+		query = append(query, results...)
+		payload = append(payload[:len(payload):len(payload)], results...)
 
-		req, err := http.NewRequest(
-			http.MethodPost,
-			"https://api.openai.com/v1/chat/completions",
-			bytes.NewBuffer(body))
-		if err != nil {
+		req.Messages = payload.stripped()
+		if raw, err = opts.send(ctx, req, out); err != nil {
 			return x, err
 		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.token))
+		usage = usage.Add(opts.recordUsage(raw))
+	}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+	var incomplete error
+	for i := 0; i < opts.autoContinue && len(raw.Choices) > 0 && raw.Choices[0].Reason == gptFinishLength; i++ {
+		partial := raw.Choices[0].Message
+		req.Messages = append(payload.stripped(),
+			message{Role: partial.Role, Content: partial.Content},
+			message{Role: roleUser, Content: continuePrompt})
+		req.N = nil // Only the first answer gets continued
+		next, err := opts.send(ctx, req, out)
 		if err != nil {
-			return x, err
+			incomplete = fmt.Errorf("%w: %w", ErrIncomplete, err) // Keep what was paid for
+			break
+		}
+		if len(next.Choices) == 0 {
+			break
 		}
+		raw.Choices[0].Message.Content += next.Choices[0].Message.Content
+		raw.Choices[0].Reason = next.Choices[0].Reason
+		usage = usage.Add(opts.recordUsage(next))
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			return x, errors.New("API returned error")
+	if len(raw.Choices) == 0 {
+		return x, errors.New("no answer in response")
+	}
+	answers := make(conversation, 0, len(raw.Choices))
+	for _, c := range raw.Choices {
+		if c.Message.Finish = c.Reason; !c.Message.Truncated() {
+			c.Message.Finish = ""
 		}
+		answers = append(answers, c.Message)
+	}
+	answer := answers[0]
+	if len(answers) > 1 {
+		answer.Alternatives = answers
+	}
+	answer.Usage = usage
+
+	return append(query, answer), incomplete
+}
+
+// Choose returns the message switched to alternative answer i.
+func (x message) Choose(i int) (message, error) {
+	if i < 0 || i >= len(x.Alternatives) {
+		return x, fmt.Errorf("no answer %d to choose", i+1)
+	}
+	alt := x.Alternatives[i]
+	x.Content = alt.Content
+	x.Finish = alt.Finish
+	x.Choice = i
+	return x, nil
+}
+
+// runTool runs the call once approved, or tells the model it was not.
+func (x options) runTool(ctx context.Context, c toolCall) message {
+	if x.approveTool != nil && !x.approveTool(ctx, c) {
+		return message{Role: roleTool, ToolCallID: c.ID, Content: "error: " + ErrToolDenied.Error()}
+	}
+	return x.tools.call(ctx, c)
+}
 
-		defer resp.Body.Close()
-		cnt, err := io.ReadAll(resp.Body)
+// send gets the response to the request, from cache if possible.
+func (x options) send(ctx context.Context, req gptMsg, out func(string)) (gptResponse, error) {
+	key := cacheKey(req, x.endpoint(""), x.cacheNamespace())
+	if fc, err := x.fromCache(key); err == nil {
+		raw, err := parseGptResponse(fc)
 		if err != nil {
-			return query, err
+			return raw, err
 		}
+		raw.Usage = nil // Cached responses are free
+		if out != nil && len(raw.Choices) > 0 {
+			out(raw.Choices[0].Message.Content)
+		}
+		return raw, nil
+	}
 
-		toCache(q, cnt)
-		content = cnt
-	} else {
-		content = fc
+	if !x.budgetConfirmed {
+		if err := x.budget.check(req, x.prices, x.ledger); err != nil {
+			return gptResponse{}, err
+		}
 	}
 
-	raw, err := parseGptResponse(content)
+	var raw gptResponse
+	provider := x.getProvider()
+	err := x.retry.do(ctx, func() error {
+		if out == nil {
+			var err error
+			raw, err = provider.Complete(ctx, req)
+			return err
+		}
+
+		streamed := false
+		var err error
+		raw, err = provider.Stream(ctx, req, func(delta string) {
+			streamed = true
+			out(delta)
+		})
+		if err != nil && streamed {
+			return noRetry{err: err}
+		}
+		return err
+	}, x.onRetry)
 	if err != nil {
-		return query, err
+		return raw, err
 	}
 
-	for _, m := range raw.Choices {
-		query = append(query, m.Message)
+	if x.cacheable != nil && !x.cacheable(raw) {
+		return raw, nil
 	}
+	if cnt, err := json.Marshal(raw); err == nil {
+		x.toCache(key, req, cnt)
+	}
+	return raw, nil
+}
 
-	return query, nil
+// continuePrompt asks for the rest of an answer cut off by the token limit.
+const continuePrompt = "Continue exactly where you left off, without repeating anything."
+
+// ErrIncomplete comes along with a truncated answer that failed to be
+// continued. The answer is kept in the conversation nonetheless.
+var ErrIncomplete = errors.New("answer is incomplete")
+
+// Truncated reports whether the message got cut off before it was done.
+func (x message) Truncated() bool {
+	return x.Finish == gptFinishLength || x.Finish == gptFinishFlt
+}
+
+// FinishNote describes why the message got cut off, if it did.
+func (x message) FinishNote() string {
+	switch x.Finish {
+	case gptFinishLength:
+		return "truncated"
+	case gptFinishFlt:
+		return "filtered"
+	}
+	return ""
 }
 
 func extractCodeFrom(msg string) []string {
@@ -125,23 +309,19 @@ func extractCodeFrom(msg string) []string {
 			inCode = true
 		}
 	}
+	// Keep what there is of a block cut off before its closing fence
+	if inCode && strings.TrimSpace(tmp) != "" {
+		code = append(code, strings.TrimSpace(tmp))
+	}
 	return code
 }
 
-func fromCache(q string) ([]byte, error) {
-	h := md5.New()
-	io.WriteString(h, q)
-	fname := path.Join(os.TempDir(), fmt.Sprintf("gptcli-%x", h.Sum(nil)))
-	if cnt, err := os.ReadFile(fname); err != nil {
-		return []byte{}, err
-	} else {
-		return cnt, err
+// recordUsage notes down what the response took, if the API reported it.
+func (x options) recordUsage(raw gptResponse) *messageUsage {
+	if raw.Usage == nil {
+		return nil
 	}
-}
-
-func toCache(q string, cnt []byte) error {
-	h := md5.New()
-	io.WriteString(h, q)
-	fname := path.Join(os.TempDir(), fmt.Sprintf("gptcli-%x", h.Sum(nil)))
-	return os.WriteFile(fname, cnt, 0666)
+	usage := newMessageUsage(x.model, *raw.Usage, x.prices)
+	x.ledger.Record(x.session, usage)
+	return &usage
 }
@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
-	"fmt"
-	"io/ioutil"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
-	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_extractCodeFrom(t *testing.T) {
@@ -80,57 +82,342 @@ func TestExtractCodeFrom(t *testing.T) {
 	}
 }
 
-func TestFromCache(t *testing.T) {
-	// Create a temporary file to use for testing
-	tmpfile, err := ioutil.TempFile("", "test")
+func TestLast(t *testing.T) {
+	// test case 1: empty conversation
+	conv1 := make(conversation, 0)
+	if conv1.Last() != "" {
+		t.Errorf("expected empty string, but got '%s'", conv1.Last())
+	}
+
+	// test case 2: non-empty conversation
+	conv2 := make(conversation, 3)
+	conv2[0] = message{Content: "hello"}
+	conv2[1] = message{Content: "world"}
+	conv2[2] = message{Content: "!"}
+	if conv2.Last() != "!" {
+		t.Errorf("expected '!', but got '%s'", conv2.Last())
+	}
+}
+
+type fakeProvider struct {
+	resp gptResponse
+	err  error
+	got  []gptMsg
+
+	// Replies are returned in order before falling back to resp
+	replies []gptResponse
+}
+
+func (x *fakeProvider) Complete(ctx context.Context, req gptMsg) (gptResponse, error) {
+	x.got = append(x.got, req)
+	if len(x.replies) > 0 {
+		resp := x.replies[0]
+		x.replies = x.replies[1:]
+		return resp, nil
+	}
+	return x.resp, x.err
+}
+
+func (x *fakeProvider) Stream(ctx context.Context, req gptMsg, out func(string)) (gptResponse, error) {
+	x.got = append(x.got, req)
+	for _, c := range x.resp.Choices {
+		out(c.Message.Content)
+		break
+	}
+	return x.resp, x.err
+}
+
+func newFakeProvider(content string) *fakeProvider {
+	return &fakeProvider{resp: newFakeResponse(content)}
+}
+
+func newFakeResponse(content string) gptResponse {
+	return gptResponse{Choices: []gptChoice{
+		{Message: message{Role: roleGpt, Content: content}, Reason: gptFinishStop},
+	}}
+}
+
+func TestAsk_UsesProvider(t *testing.T) {
+	q := "provider test"
+
+	p := newFakeProvider("hello")
+	c, err := conversation{message{Role: roleSystem, Content: "sys"}}.Ask(context.Background(), q, options{model: gpt4, provider: p, noCache: true})
 	if err != nil {
-		t.Fatalf("Error creating temporary file: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.got) != 1 {
+		t.Fatalf("expected one request, got %d", len(p.got))
 	}
-	defer os.Remove(tmpfile.Name())
+	if p.got[0].Model != gpt4 {
+		t.Errorf("unexpected model: %q", p.got[0].Model)
+	}
+	if len(p.got[0].Messages) != 2 || p.got[0].Messages[1].Content != q {
+		t.Errorf("unexpected request messages: %#v", p.got[0].Messages)
+	}
+	if len(c) != 3 || c.Last() != "hello" {
+		t.Errorf("unexpected conversation: %#v", c)
+	}
+}
 
-	// Write some test data to the file
-	testdata := []byte("test data")
-	if _, err := tmpfile.Write(testdata); err != nil {
-		t.Fatalf("Error writing to temporary file: %v", err)
+func TestAsk_ReturnsOriginalConversationOnProviderError(t *testing.T) {
+	q := "provider error test"
+
+	p := &fakeProvider{err: errors.New("nope")}
+	c, err := conversation{}.Ask(context.Background(), q, options{provider: p, noCache: true})
+	if err == nil {
+		t.Error("expected error")
+	}
+	if len(c) != 0 {
+		t.Errorf("expected unchanged conversation, got %#v", c)
 	}
+}
+
+func TestStream_DeliversDeltas(t *testing.T) {
+	q := "stream test"
 
-	// Generate an MD5 hash of the test data
-	h := md5.New()
-	_, err = h.Write(testdata)
+	var out strings.Builder
+	c, err := conversation{}.Stream(context.Background(), q, options{provider: newFakeProvider("streamed"), noCache: true}, func(delta string) {
+		out.WriteString(delta)
+	})
 	if err != nil {
-		t.Fatalf("Error creating MD5 hash: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
-	expectedFilename := path.Join(os.TempDir(), fmt.Sprintf("gptcli-%x", h.Sum(nil)))
+	if out.String() != "streamed" {
+		t.Errorf("unexpected streamed output: %q", out.String())
+	}
+	if c.Last() != out.String() {
+		t.Errorf("expected final message to match streamed output: %q", c.Last())
+	}
+}
+
+func TestAsk_HonorsCancelledContext(t *testing.T) {
+	q := "cancel test"
 
-	// Move the temporary file to the expected filename
-	if err := os.Rename(tmpfile.Name(), expectedFilename); err != nil {
-		t.Fatalf("Error moving temporary file: %v", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("did not expect the request to be sent")
+	}))
+	defer srv.Close()
+
+	c, err := conversation{}.Ask(ctx, q, options{token: "test", baseURL: srv.URL, retry: retryPolicy{maxAttempts: 3}, noCache: true})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation error, got %v", err)
 	}
-	defer os.Remove(expectedFilename)
+	if len(c) != 0 {
+		t.Errorf("expected unchanged conversation, got %#v", c)
+	}
+}
 
-	// Call the fromCache function and verify that it returns the expected data
-	data, err := fromCache(string(testdata))
+func TestAsk_TimesOut(t *testing.T) {
+	q := "timeout test"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	_, err := conversation{}.Ask(context.Background(), q, options{token: "test", baseURL: srv.URL, timeout: 10 * time.Millisecond, noCache: true})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestAsk_FitsPayloadIntoContextWindow(t *testing.T) {
+	p := newFakeProvider("hello")
+	convo := conversation{
+		message{Role: roleSystem, Content: "sys"},
+		message{Role: roleUser, Content: strings.Repeat("old question ", 50)},
+		message{Role: roleGpt, Content: strings.Repeat("old answer ", 50)},
+	}
+	opts := options{
+		provider: p,
+		noCache:  true,
+		window:   windowPolicy{strategy: windowTruncate, limit: 100, reserve: 10},
+	}
+
+	c, err := convo.Ask(context.Background(), "new question", opts)
 	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
-	if !bytes.Equal(data, testdata) {
-		t.Fatalf("Expected %v, but got %v", testdata, data)
+	if len(p.got[0].Messages) != 2 {
+		t.Errorf("expected oldest turn to be dropped from the request: %#v", p.got[0].Messages)
+	}
+	if len(c) != 5 {
+		t.Errorf("expected full conversation to be kept: %#v", c)
 	}
 }
 
-func TestLast(t *testing.T) {
-	// test case 1: empty conversation
-	conv1 := make(conversation, 0)
-	if conv1.Last() != "" {
-		t.Errorf("expected empty string, but got '%s'", conv1.Last())
+func TestExtractCodeFrom_KeepsUnterminatedBlock(t *testing.T) {
+	msg := "Here you go:\n```\nfirst\n```\nand\n```go\nfunc main() {\n"
+	expected := []string{"first", "func main() {"}
+	actual := extractCodeFrom(msg)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v but got %v", expected, actual)
 	}
+}
 
-	// test case 2: non-empty conversation
-	conv2 := make(conversation, 3)
-	conv2[0] = message{Content: "hello"}
-	conv2[1] = message{Content: "world"}
-	conv2[2] = message{Content: "!"}
-	if conv2.Last() != "!" {
-		t.Errorf("expected '!', but got '%s'", conv2.Last())
+func TestAsk_ContinuesTruncatedAnswer(t *testing.T) {
+	first := newFakeResponse("part one, ")
+	first.Choices[0].Reason = gptFinishLength
+	first.Usage = &gptUsage{PromptTokens: 10, CompletionTokens: 5}
+	second := newFakeResponse("part two")
+	second.Usage = &gptUsage{PromptTokens: 20, CompletionTokens: 3}
+	p := &fakeProvider{replies: []gptResponse{first, second}}
+
+	c, err := conversation{}.Ask(context.Background(), "q", options{provider: p, noCache: true, autoContinue: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.got) != 2 {
+		t.Fatalf("expected a continuation request, got %d requests", len(p.got))
+	}
+	msgs := p.got[1].Messages
+	if len(msgs) != 3 || msgs[1].Content != "part one, " || msgs[2].Content != continuePrompt {
+		t.Errorf("unexpected continuation request: %#v", msgs)
+	}
+	last := c[len(c)-1]
+	if len(c) != 2 || last.Content != "part one, part two" {
+		t.Errorf("expected stitched answer, got %#v", c)
+	}
+	if last.Truncated() {
+		t.Errorf("did not expect a finished answer to be marked: %q", last.Finish)
+	}
+	if last.Usage == nil || last.Usage.PromptTokens != 30 || last.Usage.CompletionTokens != 8 {
+		t.Errorf("expected usage to be summed, got %#v", last.Usage)
+	}
+}
+
+func TestAsk_KeepsTruncatedAnswerWhenContinuationFails(t *testing.T) {
+	first := newFakeResponse("part one, ")
+	first.Choices[0].Reason = gptFinishLength
+	p := &fakeProvider{replies: []gptResponse{first}, err: errors.New("connection lost")}
+
+	c, err := conversation{}.Ask(context.Background(), "q", options{provider: p, noCache: true, autoContinue: 2})
+	if !errors.Is(err, ErrIncomplete) || !strings.Contains(err.Error(), "connection lost") {
+		t.Errorf("expected incomplete answer error, got %v", err)
+	}
+	if len(c) != 2 || c.Last() != "part one, " || !c[1].Truncated() {
+		t.Errorf("expected partial answer marked as truncated, got %#v", c)
+	}
+}
+
+func TestAsk_MarksTruncatedAnswer(t *testing.T) {
+	resp := newFakeResponse("cut")
+	resp.Choices[0].Reason = gptFinishLength
+	p := &fakeProvider{resp: resp}
+
+	c, err := conversation{}.Ask(context.Background(), "q", options{provider: p, noCache: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.got) != 1 {
+		t.Errorf("did not expect continuations, got %d requests", len(p.got))
+	}
+	if last := c[len(c)-1]; !last.Truncated() || last.FinishNote() != "truncated" {
+		t.Errorf("expected answer to be marked truncated: %#v", last)
+	}
+	if stripped := c.stripped(); stripped[len(stripped)-1].Finish != "" {
+		t.Error("expected finish reason to be stripped from payloads")
+	}
+}
+
+func TestAsk_KeepsOneOfSeveralAnswers(t *testing.T) {
+	resp := gptResponse{Choices: []gptChoice{
+		{Message: message{Role: roleGpt, Content: "one"}, Reason: gptFinishStop},
+		{Message: message{Role: roleGpt, Content: "two"}, Reason: gptFinishLength},
+	}}
+	n := 2
+	p := &fakeProvider{resp: resp}
+
+	c, err := conversation{}.Ask(context.Background(), "q", options{provider: p, noCache: true, params: gptParams{N: &n}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(c) != 2 {
+		t.Fatalf("expected a single answer to be kept, got %#v", c)
+	}
+	last := c[len(c)-1]
+	if last.Content != "one" || len(last.Alternatives) != 2 {
+		t.Errorf("unexpected answer: %#v", last)
+	}
+
+	chosen, err := last.Choose(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if chosen.Content != "two" || chosen.Choice != 1 || !chosen.Truncated() {
+		t.Errorf("unexpected chosen answer: %#v", chosen)
+	}
+	if _, err := last.Choose(2); err == nil {
+		t.Error("expected error choosing a missing answer")
+	}
+	if stripped := c.stripped(); stripped[1].Alternatives != nil {
+		t.Error("expected alternatives to be stripped from payloads")
+	}
+}
+
+func TestAsk_RunsRequestedTools(t *testing.T) {
+	calls := gptResponse{Choices: []gptChoice{{
+		Message: message{Role: roleGpt, ToolCalls: []toolCall{
+			{ID: "call_1", Type: "function", Function: toolCallFunction{Name: "echo", Arguments: `{"text":"hi"}`}},
+			{ID: "call_2", Type: "function", Function: toolCallFunction{Name: "echo", Arguments: `{"text":"no"}`}},
+		}},
+		Reason: gptFinishToolCalls,
+	}}}
+	p := &fakeProvider{resp: newFakeResponse("done"), replies: []gptResponse{calls}}
+
+	opts := options{provider: p, noCache: true}
+	err := opts.tools.Register(Tool{
+		Name: "echo",
+		Run: func(ctx context.Context, args json.RawMessage) (string, error) {
+			return string(args), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts.approveTool = func(ctx context.Context, call toolCall) bool {
+		return call.ID == "call_1"
+	}
+
+	c, err := conversation{}.Ask(context.Background(), "q", opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.got) != 2 || len(p.got[0].Tools) != 1 {
+		t.Fatalf("expected tools to be offered and a follow-up request, got %#v", p.got)
+	}
+	sent := p.got[1].Messages
+	if len(sent) != 4 || len(sent[1].ToolCalls) != 2 || sent[2].ToolCallID != "call_1" || sent[3].Role != roleTool {
+		t.Errorf("unexpected follow-up request: %#v", sent)
+	}
+	if sent[2].Content != `{"text":"hi"}` {
+		t.Errorf("unexpected tool result: %q", sent[2].Content)
+	}
+	if !strings.Contains(sent[3].Content, ErrToolDenied.Error()) {
+		t.Errorf("expected denied call to be reported: %q", sent[3].Content)
+	}
+	if len(c) != 5 || c.Last() != "done" {
+		t.Errorf("unexpected conversation: %#v", c)
+	}
+}
+
+func TestAsk_GivesUpOnEndlessToolCalls(t *testing.T) {
+	calls := gptResponse{Choices: []gptChoice{{
+		Message: message{Role: roleGpt, ToolCalls: []toolCall{
+			{ID: "call_1", Type: "function", Function: toolCallFunction{Name: "nope"}},
+		}},
+		Reason: gptFinishToolCalls,
+	}}}
+	p := &fakeProvider{resp: calls}
+
+	_, err := conversation{}.Ask(context.Background(), "q", options{provider: p, noCache: true, tools: toolRegistry{rounds: 2}})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if len(p.got) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(p.got))
 	}
 }
@@ -1,6 +1,14 @@
 package main
 
-import "encoding/json"
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+const defaultBaseURL string = "https://api.openai.com/v1"
 
 type gptModel string
 
@@ -10,8 +18,21 @@ const (
 )
 
 type gptMsg struct {
-	Model    gptModel     `json:"model"`
-	Messages conversation `json:"messages"`
+	Model          gptModel           `json:"model"`
+	Messages       conversation       `json:"messages"`
+	Stream         bool               `json:"stream,omitempty"`
+	StreamOptions  *gptStreamOptions  `json:"stream_options,omitempty"`
+	Tools          []gptTool          `json:"tools,omitempty"`
+	ResponseFormat *gptResponseFormat `json:"response_format,omitempty"`
+	gptParams
+}
+
+type gptResponseFormat struct {
+	Type string `json:"type"`
+}
+
+type gptStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type gptFinishReason string
@@ -19,7 +40,8 @@ type gptFinishReason string
 const (
 	gptFinishStop       gptFinishReason = "stop"
 	gptFinishLength     gptFinishReason = "length"
-	gptFinishFlt        gptFinishReason = "filter"
+	gptFinishFlt        gptFinishReason = "content_filter"
+	gptFinishToolCalls  gptFinishReason = "tool_calls"
 	gptFinishIncomplete gptFinishReason = "null"
 )
 
@@ -34,9 +56,101 @@ func parseGptResponse(buf []byte) (gptResponse, error) {
 
 type gptResponse struct {
 	Choices []gptChoice `json:"choices"`
+	Usage   *gptUsage   `json:"usage,omitempty"`
 }
 
 type gptChoice struct {
 	Message message         `json:"message"`
 	Reason  gptFinishReason `json:"finish_reason"`
 }
+
+type gptStreamChunk struct {
+	Choices []gptStreamChoice `json:"choices"`
+	Usage   *gptUsage         `json:"usage,omitempty"`
+}
+
+type gptStreamChoice struct {
+	Index  int             `json:"index"`
+	Delta  gptStreamDelta  `json:"delta"`
+	Reason gptFinishReason `json:"finish_reason"`
+}
+
+type gptStreamDelta struct {
+	Role      role            `json:"role"`
+	Content   string          `json:"content"`
+	ToolCalls []toolCallDelta `json:"tool_calls"`
+}
+
+// toolCallDelta is a piece of the tool call at Index, whose arguments
+// arrive in fragments.
+type toolCallDelta struct {
+	Index int `json:"index"`
+	toolCall
+}
+
+// parseGptStream reads server-sent chat completion chunks and assembles
+// them into a regular response, passing first choice deltas to out.
+func parseGptStream(r io.Reader, out func(string)) (gptResponse, error) {
+	x := gptResponse{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk gptStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return x, err
+		}
+		if chunk.Usage != nil {
+			x.Usage = chunk.Usage
+		}
+		for _, c := range chunk.Choices {
+			for len(x.Choices) <= c.Index {
+				x.Choices = append(x.Choices, gptChoice{Message: message{Role: roleGpt}})
+			}
+			choice := &x.Choices[c.Index]
+			if c.Delta.Role != "" {
+				choice.Message.Role = c.Delta.Role
+			}
+			choice.Message.Content += c.Delta.Content
+			for _, tc := range c.Delta.ToolCalls {
+				for len(choice.Message.ToolCalls) <= tc.Index {
+					choice.Message.ToolCalls = append(choice.Message.ToolCalls, toolCall{Type: "function"})
+				}
+				call := &choice.Message.ToolCalls[tc.Index]
+				if tc.ID != "" {
+					call.ID = tc.ID
+				}
+				if tc.Function.Name != "" {
+					call.Function.Name = tc.Function.Name
+				}
+				call.Function.Arguments += tc.Function.Arguments
+			}
+			if c.Reason != "" {
+				choice.Reason = c.Reason
+			}
+			if out != nil && c.Index == 0 && c.Delta.Content != "" {
+				out(c.Delta.Content)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return x, err
+	}
+
+	if len(x.Choices) == 0 {
+		return x, errors.New("empty response stream")
+	}
+	for _, c := range x.Choices {
+		if c.Reason == "" {
+			return x, errors.New("response stream ended prematurely")
+		}
+	}
+	return x, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -12,3 +13,67 @@ func Test_parseGptResponse(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func Test_parseGptStream(t *testing.T) {
+	f, err := os.Open("testdata/stream.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	deltas := []string{}
+	x, err := parseGptStream(f, func(delta string) {
+		deltas = append(deltas, delta)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deltas) != 2 {
+		t.Errorf("expected 2 deltas, got %#v", deltas)
+	}
+	if len(x.Choices) != 1 {
+		t.Fatalf("expected one choice, got %#v", x.Choices)
+	}
+	if x.Choices[0].Message.Content != "Use `ls -la`" {
+		t.Errorf("unexpected content: %q", x.Choices[0].Message.Content)
+	}
+	if x.Choices[0].Message.Role != roleGpt {
+		t.Errorf("unexpected role: %q", x.Choices[0].Message.Role)
+	}
+	if x.Choices[0].Reason != gptFinishStop {
+		t.Errorf("unexpected finish reason: %q", x.Choices[0].Reason)
+	}
+	if x.Usage == nil || x.Usage.TotalTokens != 13 {
+		t.Errorf("expected usage from the final chunk: %#v", x.Usage)
+	}
+}
+
+func Test_parseGptStream_ErrorsOutOnPrematureEnd(t *testing.T) {
+	stream := `data: {"choices":[{"index":0,"delta":{"content":"Use"},"finish_reason":null}]}`
+	if _, err := parseGptStream(strings.NewReader(stream), nil); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func Test_parseGptStream_AssemblesToolCalls(t *testing.T) {
+	stream := strings.Join([]string{
+		`data: {"choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"read_file","arguments":""}}]},"finish_reason":null}]}`,
+		`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":"}}]},"finish_reason":null}]}`,
+		`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"go.mod\"}"}}]},"finish_reason":"tool_calls"}]}`,
+		`data: [DONE]`,
+	}, "\n")
+	x, err := parseGptStream(strings.NewReader(stream), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := x.Choices[0].Message.ToolCalls
+	if len(calls) != 1 {
+		t.Fatalf("expected one tool call, got %#v", calls)
+	}
+	if calls[0].ID != "call_1" || calls[0].Function.Name != "read_file" || calls[0].Function.Arguments != `{"path":"go.mod"}` {
+		t.Errorf("unexpected tool call: %#v", calls[0])
+	}
+	if x.Choices[0].Reason != gptFinishToolCalls {
+		t.Errorf("unexpected finish reason: %q", x.Choices[0].Reason)
+	}
+}
@@ -2,17 +2,54 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"time"
 )
 
 type options struct {
-	token       string
+	token        string
+	baseURL      string
+	organization string
+	headers      map[string]string
+	streamUsage  bool
+	provider     Provider
+	retry        retryPolicy
+	timeout      time.Duration
+	window       windowPolicy
+	summary      summaryPolicy
+	prices       map[gptModel]ModelPrice
+	ledger       usageLedger
+	budget       budgetPolicy
+	params       gptParams
+	tools        toolRegistry
+	autoContinue int
+	jsonMode     bool
+	instructions string // System message sent along with the question only
+	cacheable    func(gptResponse) bool
+	personas     func() (map[string]Persona, error) // Loaded only when one is asked for
+	attach       attachPolicy
+
+	budgetConfirmed bool
+	onRetry         func(attempt, max int, err error)
+	approveTool     func(ctx context.Context, call toolCall) bool
+
 	model       gptModel
 	prompt      string
 	interactive bool
+	stream      bool
+	session     string
+	noCache     bool
+	refresh     bool // Skip cached responses, but still cache the new ones
+	cacheScope  string
+	cache       responseCache
 }
 
 func hasPipedInput() bool {
@@ -24,17 +61,57 @@ func hasPipedInput() bool {
 
 func main() {
 	opts := options{
+		baseURL:     defaultBaseURL,
 		model:       gpt3,
 		prompt:      "bash",
 		interactive: false,
 	}
 
-	flag.StringVar(&opts.prompt, "prompt", "", "Ask for help about topic (bash, php...)")
-	flag.StringVar(&opts.prompt, "p", "", "Ask for help about topic (bash, php...)")
+	flag.StringVar(&opts.prompt, "prompt", "", "Use a persona, or ask for help about topic (bash, php...)")
+	flag.StringVar(&opts.prompt, "p", "", "Use a persona, or ask for help about topic (bash, php...)")
 
 	flag.BoolVar(&opts.interactive, "interactive", false, "Start in interactive mode right away")
 	flag.BoolVar(&opts.interactive, "i", false, "Start in interactive mode right away")
 
+	flag.BoolVar(&opts.stream, "stream", false, "Stream responses as they are generated")
+	flag.BoolVar(&opts.stream, "s", false, "Stream responses as they are generated")
+
+	var cliParams gptParams
+	for _, name := range paramNames {
+		name := name
+		flag.Func(strings.ReplaceAll(name, "_", "-"), fmt.Sprintf("Set the %s sampling parameter", name), func(value string) error {
+			return cliParams.Set(name, value)
+		})
+	}
+
+	autoContinue := -1
+	flag.IntVar(&autoContinue, "auto-continue", -1, "Ask for up to N continuations of answers cut off by the token limit")
+
+	var asJSON bool
+	flag.BoolVar(&asJSON, "json", false, "Print multiple answers as a JSON array")
+
+	var templateName string
+	flag.StringVar(&templateName, "template", "", "Build the question from the named prompt template")
+	flag.StringVar(&templateName, "t", "", "Build the question from the named prompt template")
+	vars := templateVars{}
+	flag.Var(vars, "var", "Set a template variable, as name=value (repeatable)")
+
+	var schemaPath string
+	flag.StringVar(&schemaPath, "json-schema", "", "Reply with JSON validated against the schema in this file")
+	var schemaRetries int
+	flag.IntVar(&schemaRetries, "schema-retries", defaultSchemaRetries, "Ask again up to N times when the reply does not match the schema")
+
+	flag.BoolVar(&opts.noCache, "no-cache", false, "Do not use cached responses")
+
+	var yesTools bool
+	flag.BoolVar(&yesTools, "yes-tools", false, "Run tool calls without asking y/N on the terminal first")
+
+	flag.StringVar(&opts.session, "session", "", "Save the conversation as (or resume) a named session")
+
+	var resume, listOnly bool
+	flag.BoolVar(&resume, "continue", false, "Resume the most recent session")
+	flag.BoolVar(&listOnly, "list-sessions", false, "List saved sessions")
+
 	var init bool
 	flag.BoolVar(&init, "init", false, "Initialize configuration")
 
@@ -45,6 +122,18 @@ func main() {
 			panic(err)
 		}
 		os.Exit(0)
+	} else if listOnly {
+		if err := printSessions(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	} else if ok, err := runCommand(flag.Args(), loadConfig(), os.Stdout); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	} else if !hasConfigFile() {
 		fmt.Println("Unable to find config file, please run with --init flag")
 		os.Exit(1)
@@ -57,45 +146,203 @@ func main() {
 		os.Exit(1)
 	}
 	opts.token = cfg.Token
+	opts.organization = cfg.Organization
+	opts.headers = cfg.Headers
+	if cfg.BaseURL != "" {
+		opts.baseURL = cfg.BaseURL
+	}
 	if cfg.Model != "" {
 		opts.model = cfg.Model
 	}
+	if cfg.Stream {
+		opts.stream = true
+	}
+	opts.streamUsage = strings.HasPrefix(opts.endpoint(""), defaultBaseURL)
+	if cfg.StreamUsage != nil {
+		opts.streamUsage = *cfg.StreamUsage
+	}
+	opts.provider = newOpenAIProvider(opts)
+	opts.retry = newRetryPolicy(cfg.Retry)
+	if cfg.Cache.Disabled {
+		opts.noCache = true
+	}
+	opts.cacheScope = cfg.Cache.Scope
+	opts.cache = newResponseCache(cfg.Cache)
+	window, err := newWindowPolicy(cfg.Context)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts.window = window
+	opts.summary = newSummaryPolicy(cfg.Summary)
+	opts.prices = cfg.Prices
+	opts.ledger = newUsageLedger()
+	opts.budget = newBudgetPolicy(cfg.Budget)
+	opts.params = cfg.Params
+	opts.autoContinue = cfg.AutoContinue
+	opts.attach = newAttachPolicy(cfg.Attachments)
+	opts.personas = func() (map[string]Persona, error) {
+		return loadPersonas(cfg)
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		if opts.tools, err = newToolRegistry(cfg.Tools, cwd); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if autoContinue >= 0 {
+		opts.autoContinue = autoContinue
+	}
+	if cfg.Timeout > 0 {
+		opts.timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+
+	var schema *jsonSchema
+	if schemaPath != "" {
+		s, err := loadJSONSchema(schemaPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		schema = &s
+	}
 
-	var convo conversation
+	var (
+		convo   conversation
+		history *chatNode
+	)
+	if resume || opts.session != "" {
+		var (
+			s   session
+			err error
+		)
+		if resume && opts.session == "" {
+			s, err = lastSession()
+		} else {
+			s, err = loadSession(opts.session)
+		}
+		if err == nil {
+			opts.session = s.Name
+			convo = s.Messages
+			history = s.Tree
+			if s.Model != "" {
+				opts.model = s.Model
+			}
+			if s.Params != nil {
+				opts.params = opts.params.Merge(*s.Params)
+			}
+		} else if resume || !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	var persona Persona
 	if opts.prompt != "" {
-		convo = conversation{
-			message{
-				Role:    roleSystem,
-				Content: fmt.Sprintf("You are a helpful assistant that helps with %s.", opts.prompt),
-			},
+		personas, err := opts.getPersonas()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-	} else {
-		convo = conversation{}
+		persona = findPersona(opts.prompt, personas)
+		opts = persona.Apply(opts) // Wins over the resumed session
+	}
+	opts.params = opts.params.Merge(cliParams)
+	if err := opts.params.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	var questionBuilder strings.Builder
-	questionBuilder.WriteString(
-		strings.TrimSpace(strings.Join(flag.Args(), " ")))
+	if len(convo) == 0 && opts.prompt != "" {
+		convo = persona.Conversation()
+	}
+
+	var stdin string
 	if hasPipedInput() {
-		questionBuilder.WriteString("\n")
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			questionBuilder.WriteString(scanner.Text())
-			questionBuilder.WriteString("\n")
+		buf, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		stdin = string(buf)
+	}
+	tmpl := defaultTemplate
+	if templateName != "" {
+		if tmpl, err = loadTemplate(templateName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 	}
+	args, warnings := opts.attach.expand(strings.Join(flag.Args(), " "))
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	question, err := renderPrompt(tmpl, []string{args}, stdin, vars)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	question := questionBuilder.String()
-	if question == "" {
+	if strings.TrimSpace(question) == "" && schema != nil {
+		fmt.Fprintln(os.Stderr, "--json-schema needs a question")
+		os.Exit(1)
+	} else if strings.TrimSpace(question) == "" {
 		opts.interactive = true
 	} else {
-		var err error
-		convo, err = convo.Ask(question, opts)
-		if err != nil {
-			panic(err)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		opts.approveTool = approveOnTerminal
+		if yesTools {
+			opts.approveTool = func(ctx context.Context, call toolCall) bool {
+				fmt.Fprintf(os.Stderr, "running %s\n", call)
+				return true
+			}
+		}
+		var (
+			reply      json.RawMessage
+			err        error
+			incomplete error
+		)
+		multiple := opts.params.N != nil && *opts.params.N > 1
+		if schema != nil {
+			convo, reply, err = convo.AskJSON(ctx, question, *schema, schemaRetries, opts)
+		} else if opts.stream && !opts.interactive && !multiple {
+			convo, err = convo.Stream(ctx, question, opts, func(delta string) {
+				fmt.Print(delta)
+			})
+			fmt.Println()
+		} else {
+			convo, err = convo.Ask(ctx, question, opts)
+		}
+		stop()
+		if errors.Is(err, ErrIncomplete) && schema == nil {
+			incomplete = err // Still gets saved and printed
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if last := convo[len(convo)-1]; last.Truncated() {
+			fmt.Fprintf(os.Stderr, "warning: answer was %s (finish reason %q)\n", last.FinishNote(), last.Finish)
+		}
+		if opts.session != "" {
+			if history != nil {
+				history.Set(convo)
+			}
+			if err := saveSession(session{Name: opts.session, Messages: convo, Tree: history, Params: &opts.params, Model: opts.model}); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
 		}
 
-		if !opts.interactive {
+		if reply != nil {
+			fmt.Println(string(reply))
+		} else if last := convo[len(convo)-1]; len(last.Alternatives) > 1 && !opts.interactive {
+			if err := printAnswers(os.Stdout, last, asJSON); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		} else if opts.stream && !opts.interactive {
+			if len(convo.ParseCode()) > 1 {
+				opts.interactive = true
+			}
+		} else if !opts.interactive {
 			code := convo.ParseCode()
 			if len(code) > 1 {
 				opts.interactive = true
@@ -108,9 +355,105 @@ func main() {
 				}
 			}
 		}
+		if incomplete != nil {
+			fmt.Fprintln(os.Stderr, incomplete)
+			os.Exit(1)
+		}
 	}
 
 	if opts.interactive {
-		chat(opts, convo)
+		if opts.session == "" {
+			opts.session = newSessionName()
+		}
+		chat(opts, convo, history)
+	}
+}
+
+// approveOnTerminal asks on the terminal whether the tool call may run,
+// as stdin may be taken by the question. Without one, the call is refused.
+func approveOnTerminal(ctx context.Context, call toolCall) bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "not running %s without a terminal to ask on, see --yes-tools\n", call)
+		return false
+	}
+	defer tty.Close()
+	return askApproval(ctx, call, tty, tty)
+}
+
+func askApproval(ctx context.Context, call toolCall, in io.Reader, out io.Writer) bool {
+	fmt.Fprintf(out, "Run %s? (y/N) ", call)
+	answer := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(in).ReadString('\n')
+		answer <- line
+	}()
+	select {
+	case line := <-answer:
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true
+		}
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// systemPrompt primes the assistant to help with the topic.
+func systemPrompt(topic string) string {
+	return fmt.Sprintf("You are a helpful assistant that helps with %s.", topic)
+}
+
+func (x options) endpoint(path string) string {
+	base := x.baseURL
+	if base == "" {
+		base = defaultBaseURL
+	}
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+func (x options) getPersonas() (map[string]Persona, error) {
+	if x.personas == nil {
+		return nil, nil
+	}
+	return x.personas()
+}
+
+func (x options) getProvider() Provider {
+	if x.provider != nil {
+		return x.provider
+	}
+	return newOpenAIProvider(x)
+}
+
+// printAnswers writes out every alternative answer, numbered or as
+// a JSON array of strings.
+func printAnswers(w io.Writer, msg message, asJSON bool) error {
+	if asJSON {
+		answers := make([]string, 0, len(msg.Alternatives))
+		for _, alt := range msg.Alternatives {
+			answers = append(answers, alt.Content)
+		}
+		return json.NewEncoder(w).Encode(answers)
+	}
+	for i, alt := range msg.Alternatives {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "[%d]\n%s\n", i+1, strings.TrimSpace(alt.Content))
+	}
+	return nil
+}
+
+func printSessions() error {
+	sessions, err := listSessions()
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		fmt.Printf("%s\t%s\t%d messages\n",
+			s.Name, s.Updated.Format("2006-01-02 15:04"), len(s.Messages))
 	}
+	return nil
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func Test_printAnswers(t *testing.T) {
+	msg := message{Role: roleGpt, Content: "one", Alternatives: conversation{
+		message{Role: roleGpt, Content: "one"},
+		message{Role: roleGpt, Content: "two\n"},
+	}}
+
+	var out strings.Builder
+	if err := printAnswers(&out, msg, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "[1]\none\n\n[2]\ntwo\n"; out.String() != want {
+		t.Errorf("want %q, got %q", want, out.String())
+	}
+
+	out.Reset()
+	if err := printAnswers(&out, msg, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "[\"one\",\"two\\n\"]\n"; out.String() != want {
+		t.Errorf("want %q, got %q", want, out.String())
+	}
+}
+
+func Test_askApproval(t *testing.T) {
+	call := toolCall{}
+	call.Function.Name = "shell"
+	for answer, want := range map[string]bool{"y\n": true, "YES\n": true, "n\n": false, "\n": false, "": false} {
+		var out strings.Builder
+		if got := askApproval(context.Background(), call, strings.NewReader(answer), &out); got != want {
+			t.Errorf("%q: want %v, got %v", answer, want, got)
+		}
+		if !strings.Contains(out.String(), "(y/N)") {
+			t.Errorf("expected a question, got %q", out.String())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	in, _ := io.Pipe()
+	if askApproval(ctx, call, in, io.Discard) {
+		t.Error("expected refusal once cancelled")
+	}
+}
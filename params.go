@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxStopSequences int = 4
+	maxChoices       int = 128
+)
+
+// gptParams are the sampling parameters sent along with the messages.
+type gptParams struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	MaxTokens        *int     `json:"max_tokens,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	User             string   `json:"user,omitempty"`
+	N                *int     `json:"n,omitempty"`
+}
+
+var paramNames = []string{
+	"temperature",
+	"top_p",
+	"max_tokens",
+	"presence_penalty",
+	"frequency_penalty",
+	"stop",
+	"seed",
+	"user",
+	"n",
+}
+
+// Set parses the value into the named parameter. Setting an empty value,
+// or "default", resets the parameter.
+func (x *gptParams) Set(name, value string) error {
+	value = strings.TrimSpace(value)
+	reset := value == "" || value == "default"
+	name = strings.ReplaceAll(strings.ToLower(name), "-", "_")
+
+	var err error
+	switch name {
+	case "temperature":
+		x.Temperature, err = parseFloatParam(value, reset)
+	case "top_p":
+		x.TopP, err = parseFloatParam(value, reset)
+	case "max_tokens":
+		x.MaxTokens, err = parseIntParam(value, reset)
+	case "presence_penalty":
+		x.PresencePenalty, err = parseFloatParam(value, reset)
+	case "frequency_penalty":
+		x.FrequencyPenalty, err = parseFloatParam(value, reset)
+	case "seed":
+		x.Seed, err = parseIntParam(value, reset)
+	case "stop":
+		x.Stop = nil
+		if !reset {
+			x.Stop = strings.Split(value, ",")
+		}
+	case "n":
+		x.N, err = parseIntParam(value, reset)
+	case "user":
+		x.User = ""
+		if !reset {
+			x.User = value
+		}
+	default:
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return x.Validate()
+}
+
+func parseFloatParam(value string, reset bool) (*float64, error) {
+	if reset {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func parseIntParam(value string, reset bool) (*int, error) {
+	if reset {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+// Validate checks the parameters against the ranges the API accepts.
+func (x gptParams) Validate() error {
+	errs := []error{}
+	checkRange := func(name string, value *float64, min, max float64) {
+		if value != nil && (*value < min || *value > max) {
+			errs = append(errs, fmt.Errorf("%s must be between %g and %g", name, min, max))
+		}
+	}
+	checkRange("temperature", x.Temperature, 0, 2)
+	checkRange("top_p", x.TopP, 0, 1)
+	checkRange("presence_penalty", x.PresencePenalty, -2, 2)
+	checkRange("frequency_penalty", x.FrequencyPenalty, -2, 2)
+	if x.MaxTokens != nil && *x.MaxTokens < 1 {
+		errs = append(errs, errors.New("max_tokens must be positive"))
+	}
+	if x.N != nil && (*x.N < 1 || *x.N > maxChoices) {
+		errs = append(errs, fmt.Errorf("n must be between 1 and %d", maxChoices))
+	}
+	if len(x.Stop) > maxStopSequences {
+		errs = append(errs, fmt.Errorf("at most %d stop sequences are allowed", maxStopSequences))
+	}
+	return errors.Join(errs...)
+}
+
+// Merge returns the parameters with the ones set in override replacing them.
+func (x gptParams) Merge(override gptParams) gptParams {
+	if override.Temperature != nil {
+		x.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		x.TopP = override.TopP
+	}
+	if override.MaxTokens != nil {
+		x.MaxTokens = override.MaxTokens
+	}
+	if override.PresencePenalty != nil {
+		x.PresencePenalty = override.PresencePenalty
+	}
+	if override.FrequencyPenalty != nil {
+		x.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if override.Stop != nil {
+		x.Stop = override.Stop
+	}
+	if override.Seed != nil {
+		x.Seed = override.Seed
+	}
+	if override.User != "" {
+		x.User = override.User
+	}
+	if override.N != nil {
+		x.N = override.N
+	}
+	return x
+}
+
+// String lists the parameters that are set, as name=value pairs.
+func (x gptParams) String() string {
+	set := map[string]string{}
+	if x.Temperature != nil {
+		set["temperature"] = strconv.FormatFloat(*x.Temperature, 'g', -1, 64)
+	}
+	if x.TopP != nil {
+		set["top_p"] = strconv.FormatFloat(*x.TopP, 'g', -1, 64)
+	}
+	if x.MaxTokens != nil {
+		set["max_tokens"] = strconv.Itoa(*x.MaxTokens)
+	}
+	if x.PresencePenalty != nil {
+		set["presence_penalty"] = strconv.FormatFloat(*x.PresencePenalty, 'g', -1, 64)
+	}
+	if x.FrequencyPenalty != nil {
+		set["frequency_penalty"] = strconv.FormatFloat(*x.FrequencyPenalty, 'g', -1, 64)
+	}
+	if x.Stop != nil {
+		set["stop"] = strconv.Quote(strings.Join(x.Stop, ","))
+	}
+	if x.Seed != nil {
+		set["seed"] = strconv.Itoa(*x.Seed)
+	}
+	if x.User != "" {
+		set["user"] = x.User
+	}
+	if x.N != nil {
+		set["n"] = strconv.Itoa(*x.N)
+	}
+
+	pairs := make([]string, 0, len(set))
+	for name, value := range set {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func Test_gptParams_Set(t *testing.T) {
+	x := gptParams{}
+	for name, value := range map[string]string{
+		"temperature":       "0.2",
+		"top-p":             "0.9",
+		"max_tokens":        "256",
+		"presence_penalty":  "-1",
+		"frequency_penalty": "1.5",
+		"stop":              "###,END",
+		"seed":              "42",
+		"user":              "me",
+		"n":                 "3",
+	} {
+		if err := x.Set(name, value); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	want := `frequency_penalty=1.5 max_tokens=256 n=3 presence_penalty=-1 seed=42 stop="###,END" temperature=0.2 top_p=0.9 user=me`
+	if x.String() != want {
+		t.Errorf("want %q, got %q", want, x.String())
+	}
+
+	if err := x.Set("temperature", "default"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if x.Temperature != nil {
+		t.Error("expected temperature to be reset")
+	}
+}
+
+func Test_gptParams_Set_Validates(t *testing.T) {
+	suite := map[string]string{
+		"temperature":       "2.5",
+		"top_p":             "1.1",
+		"max_tokens":        "0",
+		"presence_penalty":  "-3",
+		"frequency_penalty": "nope",
+		"stop":              "a,b,c,d,e",
+		"seed":              "1.5",
+		"n":                 "0",
+		"wat":               "1",
+	}
+	for name, value := range suite {
+		x := gptParams{}
+		if err := x.Set(name, value); err == nil {
+			t.Errorf("%s=%s: expected error", name, value)
+		}
+	}
+}
+
+func Test_gptParams_Merge(t *testing.T) {
+	base := gptParams{}
+	base.Set("temperature", "1")
+	base.Set("seed", "1")
+	override := gptParams{}
+	override.Set("temperature", "0.5")
+
+	x := base.Merge(override)
+	if *x.Temperature != 0.5 {
+		t.Errorf("expected override, got %v", *x.Temperature)
+	}
+	if *x.Seed != 1 {
+		t.Errorf("expected base value, got %v", *x.Seed)
+	}
+}
+
+func Test_gptMsg_IncludesParams(t *testing.T) {
+	params := gptParams{}
+	params.Set("temperature", "0")
+	params.Set("max_tokens", "10")
+
+	buf, _ := json.Marshal(gptMsg{Model: gpt3, gptParams: params})
+	if !strings.Contains(string(buf), `"temperature":0`) || !strings.Contains(string(buf), `"max_tokens":10`) {
+		t.Errorf("expected params in request: %s", buf)
+	}
+	if strings.Contains(string(buf), "top_p") {
+		t.Errorf("expected unset params to be left out: %s", buf)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const personasDir string = "personas"
+
+var personaExtensions = map[string]bool{".json": true, ".txt": true, ".md": true}
+
+// Persona primes the assistant for a kind of task.
+type Persona struct {
+	System      string
+	Model       gptModel     `json:",omitempty"`
+	Temperature *float64     `json:",omitempty"`
+	Examples    conversation `json:",omitempty"` // Few-shot messages following the system prompt
+}
+
+func getPersonasDir() (string, error) {
+	dir, err := getGlobalConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, personasDir), nil
+}
+
+// loadPersonas reads the personas from the personas directory, where
+// each is either a JSON file or a plain text or markdown system prompt,
+// and then the ones in the config, which take precedence. Hidden files
+// and any others are ignored.
+func loadPersonas(cfg Config) (map[string]Persona, error) {
+	personas := map[string]Persona{}
+	if dir, err := getPersonasDir(); err == nil {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return personas, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !personaExtensions[filepath.Ext(e.Name())] {
+				continue
+			}
+			name, p, err := readPersonaFile(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return personas, err
+			}
+			personas[name] = p
+		}
+	}
+	for name, p := range cfg.Personas {
+		personas[name] = p
+	}
+	return personas, nil
+}
+
+func readPersonaFile(path string) (string, Persona, error) {
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return name, Persona{}, err
+	}
+	if ext != ".json" {
+		return name, Persona{System: strings.TrimSpace(string(buf))}, nil
+	}
+	var p Persona
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return name, p, fmt.Errorf("persona %s: %w", name, err)
+	}
+	return name, p, nil
+}
+
+// findPersona returns the named persona, or one helping with the
+// topic when there is no such persona.
+func findPersona(name string, personas map[string]Persona) Persona {
+	if p, ok := personas[name]; ok {
+		return p
+	}
+	return Persona{System: systemPrompt(name)}
+}
+
+// Conversation starts a conversation with the system prompt and examples.
+func (x Persona) Conversation() conversation {
+	c := conversation{}
+	if x.System != "" {
+		c = append(c, message{Role: roleSystem, Content: x.System})
+	}
+	return append(c, x.Examples...)
+}
+
+// Apply sets the model and temperature the persona asks for, if any.
+func (x Persona) Apply(opts options) options {
+	if x.Model != "" {
+		opts.model = x.Model
+	}
+	if x.Temperature != nil {
+		opts.params.Temperature = x.Temperature
+	}
+	return opts
+}
+
+func personasCommand(args []string, personas map[string]Persona, out io.Writer) error {
+	if len(args) == 1 && args[0] == "list" {
+		names := make([]string, 0, len(personas))
+		for name := range personas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "%s\t%s\n", name, firstLine(personas[name].System))
+		}
+		return nil
+	}
+
+	if len(args) != 2 || args[0] != "show" {
+		return errors.New("usage: personas list | personas show <name>")
+	}
+	p, ok := personas[args[1]]
+	if !ok {
+		return fmt.Errorf("no persona named %s", args[1])
+	}
+	if p.Model != "" {
+		fmt.Fprintf(out, "model:\t\t%s\n", p.Model)
+	}
+	if p.Temperature != nil {
+		fmt.Fprintf(out, "temperature:\t%s\n", strconv.FormatFloat(*p.Temperature, 'g', -1, 64))
+	}
+	fmt.Fprintf(out, "system:\n%s\n", p.System)
+	for _, m := range p.Examples {
+		fmt.Fprintf(out, "\n%s:\n%s\n", m.Role, m.Content)
+	}
+	return nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestPersonas(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir, err := getPersonasDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(dir, 0700)
+	os.WriteFile(filepath.Join(dir, "pirate.txt"), []byte("Talk like a pirate.\nAlways.\n"), 0600)
+	os.WriteFile(filepath.Join(dir, ".pirate.txt.swp"), []byte("\x00junk"), 0600)
+	os.WriteFile(filepath.Join(dir, "notes.bak"), []byte("old notes"), 0600)
+	os.WriteFile(filepath.Join(dir, "sql.json"), []byte(`{
+		"System": "You write SQL.",
+		"Model": "gpt-4",
+		"Temperature": 0,
+		"Examples": [
+			{"role": "user", "content": "all users"},
+			{"role": "assistant", "content": "SELECT * FROM users;"}
+		]
+	}`), 0600)
+}
+
+func Test_loadPersonas(t *testing.T) {
+	writeTestPersonas(t)
+	cfg := Config{Personas: map[string]Persona{
+		"pirate":   {System: "Arr."},
+		"reviewer": {System: "Review code."},
+	}}
+
+	personas, err := loadPersonas(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(personas) != 3 {
+		t.Errorf("expected 3 personas, got %#v", personas)
+	}
+	if personas["pirate"].System != "Arr." {
+		t.Errorf("expected config to take precedence, got %q", personas["pirate"].System)
+	}
+	sql := personas["sql"]
+	if sql.Model != gpt4 || sql.Temperature == nil || *sql.Temperature != 0 || len(sql.Examples) != 2 {
+		t.Errorf("unexpected persona: %#v", sql)
+	}
+}
+
+func Test_loadPersonas_WithoutDirectory(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	personas, err := loadPersonas(Config{})
+	if err != nil || len(personas) != 0 {
+		t.Errorf("expected no personas, got %#v (%v)", personas, err)
+	}
+}
+
+func Test_findPersona(t *testing.T) {
+	temperature := 0.1
+	personas := map[string]Persona{
+		"sql": {
+			System:      "You write SQL.",
+			Model:       gpt4,
+			Temperature: &temperature,
+			Examples:    conversation{message{Role: roleUser, Content: "q"}, message{Role: roleGpt, Content: "a"}},
+		},
+	}
+
+	c := findPersona("sql", personas).Conversation()
+	if len(c) != 3 || c[0].Role != roleSystem || c[0].Content != "You write SQL." {
+		t.Errorf("unexpected conversation: %#v", c)
+	}
+	opts := findPersona("sql", personas).Apply(options{model: gpt3})
+	if opts.model != gpt4 || opts.params.Temperature == nil || *opts.params.Temperature != 0.1 {
+		t.Errorf("expected model and temperature to be applied: %#v", opts)
+	}
+
+	c = findPersona("php", personas).Conversation()
+	if len(c) != 1 || c[0].Content != "You are a helpful assistant that helps with php." {
+		t.Errorf("expected fallback to the topic prompt, got %#v", c)
+	}
+	if opts := findPersona("php", personas).Apply(options{model: gpt3}); opts.model != gpt3 {
+		t.Errorf("expected model to be kept, got %q", opts.model)
+	}
+}
+
+func Test_personasCommand(t *testing.T) {
+	writeTestPersonas(t)
+
+	var out strings.Builder
+	ok, err := runCommand([]string{"personas", "list"}, Config{}, &out)
+	if !ok || err != nil {
+		t.Fatalf("expected command to run, got %v, %v", ok, err)
+	}
+	if want := "pirate\tTalk like a pirate.\nsql\tYou write SQL.\n"; out.String() != want {
+		t.Errorf("want %q, got %q", want, out.String())
+	}
+
+	out.Reset()
+	if ok, err := runCommand([]string{"personas", "show", "sql"}, Config{}, &out); !ok || err != nil {
+		t.Fatalf("expected command to run, got %v, %v", ok, err)
+	}
+	for _, want := range []string{"model:\t\tgpt-4", "temperature:\t0", "system:\nYou write SQL.", "assistant:\nSELECT * FROM users;"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in %q", want, out.String())
+		}
+	}
+
+	if _, err := runCommand([]string{"personas", "show", "nope"}, Config{}, &out); err == nil {
+		t.Error("expected error for unknown persona")
+	}
+	for _, question := range [][]string{{"personas"}, {"personas", "are", "fun"}, {"personas", "list", "them"}} {
+		if ok, _ := runCommand(question, Config{}, &out); ok {
+			t.Errorf("did not expect %q to be taken for a command", question)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Provider sends chat completion requests to a model backend.
+type Provider interface {
+	Complete(ctx context.Context, req gptMsg) (gptResponse, error)
+	Stream(ctx context.Context, req gptMsg, out func(string)) (gptResponse, error)
+}
+
+type openAIProvider struct {
+	baseURL      string
+	token        string
+	organization string
+	headers      map[string]string
+	streamUsage  bool // Not every compatible backend accepts stream_options
+
+	client *http.Client
+}
+
+func newOpenAIProvider(opts options) *openAIProvider {
+	return &openAIProvider{
+		baseURL:      opts.endpoint(""),
+		token:        opts.token,
+		organization: opts.organization,
+		headers:      opts.headers,
+		streamUsage:  opts.streamUsage,
+		client:       &http.Client{},
+	}
+}
+
+func (x *openAIProvider) Complete(ctx context.Context, req gptMsg) (gptResponse, error) {
+	req.Stream = false
+	req.StreamOptions = nil
+	resp, err := x.send(ctx, req)
+	if err != nil {
+		return gptResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	cnt, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return gptResponse{}, err
+	}
+	return parseGptResponse(cnt)
+}
+
+func (x *openAIProvider) Stream(ctx context.Context, req gptMsg, out func(string)) (gptResponse, error) {
+	req.Stream = true
+	req.StreamOptions = nil
+	if x.streamUsage {
+		req.StreamOptions = &gptStreamOptions{IncludeUsage: true}
+	}
+	resp, err := x.send(ctx, req)
+	if err != nil {
+		return gptResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	return parseGptStream(resp.Body, out)
+}
+
+func (x *openAIProvider) send(ctx context.Context, mdl gptMsg) (*http.Response, error) {
+	if x.token == "" {
+		return nil, errors.New("missing token")
+	}
+
+	body, err := json.Marshal(mdl)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		x.baseURL+"chat/completions",
+		bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range x.headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", x.token))
+	if x.organization != "" {
+		req.Header.Set("OpenAI-Organization", x.organization)
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, parseAPIError(resp)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_openAIProvider_Complete(t *testing.T) {
+	buf, _ := os.ReadFile("testdata/resp.json")
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write(buf)
+	}))
+	defer srv.Close()
+
+	p := newOpenAIProvider(options{
+		token:        "test",
+		baseURL:      srv.URL + "/v1/",
+		organization: "org-test",
+		headers:      map[string]string{"X-Test": "yes"},
+	})
+	resp, err := p.Complete(context.Background(), gptMsg{Model: gpt3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got == nil {
+		t.Fatal("expected request to hit the configured server")
+	}
+	if got.URL.Path != "/v1/chat/completions" {
+		t.Errorf("unexpected path: %q", got.URL.Path)
+	}
+	if got.Header.Get("Authorization") != "Bearer test" {
+		t.Errorf("expected auth header, got %q", got.Header.Get("Authorization"))
+	}
+	if got.Header.Get("OpenAI-Organization") != "org-test" {
+		t.Errorf("expected organization header, got %q", got.Header.Get("OpenAI-Organization"))
+	}
+	if got.Header.Get("X-Test") != "yes" {
+		t.Errorf("expected extra header, got %q", got.Header.Get("X-Test"))
+	}
+	if len(resp.Choices) != 1 {
+		t.Errorf("unexpected response: %#v", resp)
+	}
+}
+
+func Test_openAIProvider_Stream(t *testing.T) {
+	buf, _ := os.ReadFile("testdata/stream.txt")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write(buf)
+	}))
+	defer srv.Close()
+
+	var out strings.Builder
+	p := newOpenAIProvider(options{token: "test", baseURL: srv.URL})
+	resp, err := p.Stream(context.Background(), gptMsg{Model: gpt3}, func(delta string) {
+		out.WriteString(delta)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != "Use `ls -la`" {
+		t.Errorf("unexpected streamed output: %q", out.String())
+	}
+	if resp.Choices[0].Message.Content != out.String() {
+		t.Errorf("expected final message to match streamed output: %#v", resp)
+	}
+}
+
+func Test_openAIProvider_Stream_AsksForUsageOnlyIfEnabled(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(buf))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer srv.Close()
+
+	for _, usage := range []bool{false, true} {
+		p := newOpenAIProvider(options{token: "test", baseURL: srv.URL, streamUsage: usage})
+		p.Stream(context.Background(), gptMsg{Model: gpt3}, func(string) {})
+	}
+	if len(bodies) != 2 || strings.Contains(bodies[0], "stream_options") {
+		t.Errorf("expected no stream_options unless enabled: %q", bodies)
+	}
+	if len(bodies) == 2 && !strings.Contains(bodies[1], `"stream_options":{"include_usage":true}`) {
+		t.Errorf("expected stream_options once enabled: %q", bodies[1])
+	}
+}
+
+func Test_openAIProvider_MissingToken(t *testing.T) {
+	p := newOpenAIProvider(options{})
+	if _, err := p.Complete(context.Background(), gptMsg{}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func Test_openAIProvider_Complete_ReturnsAPIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"message":"Rate limit reached","type":"requests"}}`))
+	}))
+	defer srv.Close()
+
+	p := newOpenAIProvider(options{token: "test", baseURL: srv.URL})
+	_, err := p.Complete(context.Background(), gptMsg{Model: gpt3})
+	if !errors.Is(err, ErrRateLimit) {
+		t.Errorf("expected rate limit error, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetryAttempts int           = 3
+	defaultRetryDeadline time.Duration = 2 * time.Minute
+
+	retryBaseDelay time.Duration = time.Second
+	retryMaxDelay  time.Duration = 30 * time.Second
+)
+
+type RetryConfig struct {
+	MaxAttempts int `json:",omitempty"`
+	Deadline    int `json:",omitempty"` // Seconds
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	deadline    time.Duration
+}
+
+func newRetryPolicy(cfg RetryConfig) retryPolicy {
+	x := retryPolicy{
+		maxAttempts: defaultRetryAttempts,
+		deadline:    defaultRetryDeadline,
+	}
+	if cfg.MaxAttempts > 0 {
+		x.maxAttempts = cfg.MaxAttempts
+	}
+	if cfg.Deadline > 0 {
+		x.deadline = time.Duration(cfg.Deadline) * time.Second
+	}
+	return x
+}
+
+// do calls fn until it succeeds, fails with a non-retryable error,
+// or the attempts and deadline are exhausted.
+func (x retryPolicy) do(ctx context.Context, fn func() error, onRetry func(attempt, max int, err error)) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var final noRetry
+		if errors.As(err, &final) {
+			return final.err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= x.maxAttempts || !isRetryable(err) {
+			return err
+		}
+
+		wait := retryDelay(attempt, err)
+		if x.deadline > 0 && time.Since(start)+wait > x.deadline {
+			return err
+		}
+		if onRetry != nil {
+			onRetry(attempt+1, x.maxAttempts, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// noRetry marks an error that must not be retried regardless of its kind.
+type noRetry struct {
+	err error
+}
+
+func (x noRetry) Error() string { return x.err.Error() }
+func (x noRetry) Unwrap() error { return x.err }
+
+func isRetryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.Code == "insufficient_quota" {
+			return false
+		}
+		switch apiErr.Status {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func retryDelay(attempt int, err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return min64(apiErr.RetryAfter, retryMaxDelay)
+	}
+
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min64(delay, retryMaxDelay)
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
+
+func min64(x, y time.Duration) time.Duration {
+	if x < y {
+		return x
+	}
+	return y
+}
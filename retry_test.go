@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_retryPolicy_RetriesRetryableErrors(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 3}
+	calls := 0
+	notices := []int{}
+	err := policy.do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return &APIError{Status: http.StatusServiceUnavailable, RetryAfter: time.Millisecond}
+		}
+		return nil
+	}, func(attempt, max int, err error) {
+		notices = append(notices, attempt)
+	})
+
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+	if len(notices) != 2 || notices[0] != 2 || notices[1] != 3 {
+		t.Errorf("unexpected retry notices: %v", notices)
+	}
+}
+
+func Test_retryPolicy_GivesUpAfterMaxAttempts(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 2}
+	calls := 0
+	err := policy.do(context.Background(), func() error {
+		calls++
+		return &APIError{Status: http.StatusTooManyRequests, RetryAfter: time.Millisecond}
+	}, nil)
+
+	if !errors.Is(err, ErrRateLimit) {
+		t.Errorf("expected rate limit error, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
+
+func Test_retryPolicy_DoesNotRetryPermanentErrors(t *testing.T) {
+	suite := map[string]error{
+		"auth":     &APIError{Status: http.StatusUnauthorized},
+		"quota":    &APIError{Status: http.StatusTooManyRequests, Code: "insufficient_quota"},
+		"no retry": noRetry{err: syscall.ECONNRESET},
+		"generic":  errors.New("missing token"),
+	}
+	for name, want := range suite {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			err := retryPolicy{maxAttempts: 5}.do(context.Background(), func() error {
+				calls++
+				return want
+			}, nil)
+			if err == nil {
+				t.Error("expected error")
+			}
+			if calls != 1 {
+				t.Errorf("expected a single call, got %d", calls)
+			}
+		})
+	}
+}
+
+func Test_retryPolicy_RespectsDeadline(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 5, deadline: time.Second}
+	calls := 0
+	policy.do(context.Background(), func() error {
+		calls++
+		return &APIError{Status: http.StatusTooManyRequests, RetryAfter: 10 * time.Second}
+	}, nil)
+	if calls != 1 {
+		t.Errorf("expected deadline to prevent retries, got %d calls", calls)
+	}
+}
+
+func Test_retryPolicy_ReturnsCancellation(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 5}
+	ctx, cancel := context.WithCancel(context.Background())
+	err := policy.do(ctx, func() error {
+		return &APIError{Status: http.StatusTooManyRequests, RetryAfter: time.Minute}
+	}, func(int, int, error) { cancel() })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation during backoff, got %v", err)
+	}
+
+	err = policy.do(ctx, func() error {
+		return &APIError{Status: http.StatusBadGateway}
+	}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation after a failed attempt, got %v", err)
+	}
+}
+
+func Test_retryDelay(t *testing.T) {
+	for attempt := 1; attempt < 100; attempt++ {
+		d := retryDelay(attempt, syscall.ECONNRESET)
+		if d <= 0 || d > retryMaxDelay {
+			t.Errorf("attempt %d: delay out of bounds: %v", attempt, d)
+		}
+	}
+	if d := retryDelay(1, &APIError{RetryAfter: 3 * time.Second}); d != 3*time.Second {
+		t.Errorf("expected Retry-After to be honored, got %v", d)
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("7"); d != 7*time.Second {
+		t.Errorf("unexpected seconds delay: %v", d)
+	}
+	if d := parseRetryAfter(""); d != 0 {
+		t.Errorf("unexpected empty delay: %v", d)
+	}
+	when := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(when); d <= 0 || d > time.Minute {
+		t.Errorf("unexpected date delay: %v", d)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const defaultSchemaRetries int = 2
+
+var ErrSchema = errors.New("reply does not match the schema")
+
+// jsonSchema validates values against a JSON Schema. It covers the
+// keywords that matter for describing replies: type, enum, const,
+// properties, required, additionalProperties, items and the usual
+// length, range and pattern constraints. Schemas using any other
+// keyword are refused rather than half checked.
+type jsonSchema struct {
+	raw  json.RawMessage
+	root any
+}
+
+func loadJSONSchema(path string) (jsonSchema, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return jsonSchema{}, err
+	}
+	return parseJSONSchema(buf)
+}
+
+func parseJSONSchema(buf []byte) (jsonSchema, error) {
+	var root any
+	if err := json.Unmarshal(buf, &root); err != nil {
+		return jsonSchema{}, fmt.Errorf("invalid schema: %w", err)
+	}
+	switch root.(type) {
+	case map[string]any, bool:
+	default:
+		return jsonSchema{}, errors.New("invalid schema: must be an object or a boolean")
+	}
+	problems := []string{}
+	checkSchema(root, "$", &problems)
+	if len(problems) > 0 {
+		return jsonSchema{}, fmt.Errorf("invalid schema: %s", strings.Join(problems, "; "))
+	}
+	return jsonSchema{raw: bytes.TrimSpace(buf), root: root}, nil
+}
+
+// schemaKeywords are the keywords validateSchema checks, and the ones
+// that only describe the schema.
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+	"minItems": true, "maxItems": true, "items": true,
+	"properties": true, "required": true, "additionalProperties": true,
+
+	"$schema": true, "$id": true, "$comment": true,
+	"title": true, "description": true, "default": true, "examples": true,
+}
+
+// checkSchema lists the parts of the schema validateSchema cannot check.
+func checkSchema(schema any, path string, problems *[]string) {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		if _, ok := schema.(bool); !ok {
+			*problems = append(*problems, path+": must be an object or a boolean")
+		}
+		return
+	}
+
+	unsupported := []string{}
+	for k := range s {
+		if !schemaKeywords[k] {
+			unsupported = append(unsupported, k)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		*problems = append(*problems, fmt.Sprintf("%s: unsupported keywords %s", path, strings.Join(unsupported, ", ")))
+	}
+	if p, ok := s["pattern"].(string); ok {
+		if _, err := regexp.Compile(p); err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s: unsupported pattern: %v", path, err))
+		}
+	}
+
+	if items, ok := s["items"]; ok {
+		checkSchema(items, path+".items", problems)
+	}
+	if extra, ok := s["additionalProperties"]; ok {
+		checkSchema(extra, path+".additionalProperties", problems)
+	}
+	props, _ := s["properties"].(map[string]any)
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checkSchema(props[name], path+".properties."+name, problems)
+	}
+}
+
+// SchemaError lists everything wrong with a reply.
+type SchemaError struct {
+	Problems []string
+}
+
+func (x *SchemaError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrSchema, strings.Join(x.Problems, "; "))
+}
+
+func (x *SchemaError) Unwrap() error {
+	return ErrSchema
+}
+
+// Validate parses the reply as JSON and checks it against the schema.
+func (x jsonSchema) Validate(reply string) (json.RawMessage, error) {
+	reply = strings.TrimSpace(reply)
+	var v any
+	if err := json.Unmarshal([]byte(reply), &v); err != nil {
+		return nil, &SchemaError{Problems: []string{"not valid JSON: " + err.Error()}}
+	}
+	problems := []string{}
+	validateSchema(x.root, v, "$", &problems)
+	if len(problems) > 0 {
+		return nil, &SchemaError{Problems: problems}
+	}
+	return json.RawMessage(reply), nil
+}
+
+func validateSchema(schema, v any, path string, problems *[]string) {
+	fail := func(format string, args ...any) {
+		*problems = append(*problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	s, ok := schema.(map[string]any)
+	if !ok {
+		if allowed, ok := schema.(bool); ok && !allowed {
+			fail("no value is allowed here")
+		}
+		return
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, v) {
+		fail("expected %s, got %s", describeType(t), jsonType(v))
+		return
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, v)
+		}
+		if !found {
+			fail("must be one of %s", compactJSON(enum))
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, v) {
+		fail("must be %s", compactJSON(c))
+	}
+
+	switch v := v.(type) {
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if n, ok := s["minLength"].(float64); ok && length < n {
+			fail("must be at least %g characters", n)
+		}
+		if n, ok := s["maxLength"].(float64); ok && length > n {
+			fail("must be at most %g characters", n)
+		}
+		if p, ok := s["pattern"].(string); ok {
+			if re, err := regexp.Compile(p); err == nil && !re.MatchString(v) {
+				fail("must match %q", p)
+			}
+		}
+	case float64:
+		if n, ok := s["minimum"].(float64); ok && v < n {
+			fail("must be at least %g", n)
+		}
+		if n, ok := s["maximum"].(float64); ok && v > n {
+			fail("must be at most %g", n)
+		}
+		if n, ok := s["exclusiveMinimum"].(float64); ok && v <= n {
+			fail("must be greater than %g", n)
+		}
+		if n, ok := s["exclusiveMaximum"].(float64); ok && v >= n {
+			fail("must be less than %g", n)
+		}
+	case []any:
+		if n, ok := s["minItems"].(float64); ok && float64(len(v)) < n {
+			fail("must have at least %g items", n)
+		}
+		if n, ok := s["maxItems"].(float64); ok && float64(len(v)) > n {
+			fail("must have at most %g items", n)
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range v {
+				validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i), problems)
+			}
+		}
+	case map[string]any:
+		if required, ok := s["required"].([]any); ok {
+			for _, name := range required {
+				if name, ok := name.(string); ok {
+					if _, ok := v[name]; !ok {
+						fail("missing required property %q", name)
+					}
+				}
+			}
+		}
+		props, _ := s["properties"].(map[string]any)
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := props[name]; ok {
+				validateSchema(prop, v[name], path+"."+name, problems)
+			} else if extra, ok := s["additionalProperties"]; ok {
+				validateSchema(extra, v[name], path+"."+name, problems)
+			}
+		}
+	}
+}
+
+func matchesType(t, v any) bool {
+	switch t := t.(type) {
+	case string:
+		actual := jsonType(v)
+		return actual == t || (t == "number" && actual == "integer")
+	case []any:
+		for _, each := range t {
+			if matchesType(each, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func describeType(t any) string {
+	if types, ok := t.([]any); ok {
+		names := []string{}
+		for _, each := range types {
+			names = append(names, fmt.Sprint(each))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func compactJSON(v any) string {
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
+
+// AskJSON asks for a reply in JSON mode matching the schema, feeding
+// validation problems back to the model up to retries times. Replies
+// not matching the schema are kept out of the cache.
+func (x conversation) AskJSON(ctx context.Context, q string, schema jsonSchema, retries int, opts options) (conversation, json.RawMessage, error) {
+	opts.jsonMode = true
+	opts.instructions = fmt.Sprintf("Reply with only a JSON value matching this JSON Schema:\n%s", schema.raw)
+	opts.cacheable = func(raw gptResponse) bool {
+		if len(raw.Choices) == 0 {
+			return false
+		}
+		_, err := schema.Validate(raw.Choices[0].Message.Content)
+		return err == nil
+	}
+
+	c, err := x.Ask(ctx, q, opts)
+	for attempt := 0; err == nil; attempt++ {
+		reply, invalid := schema.Validate(c.Last())
+		if invalid == nil {
+			return c, reply, nil
+		}
+		if attempt >= retries {
+			return c, nil, invalid
+		}
+		var problems *SchemaError
+		errors.As(invalid, &problems)
+		feedback := "Your reply does not match the schema:\n- " + strings.Join(problems.Problems, "\n- ") +
+			"\nReply again with only the corrected JSON."
+		c, err = c.Ask(ctx, feedback, opts)
+	}
+	return c, nil, err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+		"kind": {"enum": ["cat", "dog"]}
+	},
+	"required": ["name", "age"],
+	"additionalProperties": false
+}`
+
+func Test_jsonSchema_Validate(t *testing.T) {
+	schema, err := parseJSONSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	suite := map[string]string{
+		`{"name":"Rex","age":3,"tags":["a"],"kind":"dog"}`: "",
+		` {"name":"Rex","age":3} `:                         "",
+		`{"name":"Rex"`:                                    "not valid JSON",
+		`[]`:                                               "$: expected object, got array",
+		`{"name":"Rex"}`:                                   `$: missing required property "age"`,
+		`{"name":"","age":3}`:                              "$.name: must be at least 1 characters",
+		`{"name":"Rex","age":3.5}`:                         "$.age: expected integer, got number",
+		`{"name":"Rex","age":-1}`:                          "$.age: must be at least 0",
+		`{"name":"Rex","age":3,"tags":["a",1]}`:            "$.tags[1]: expected string, got integer",
+		`{"name":"Rex","age":3,"tags":["a","b","c"]}`:      "$.tags: must have at most 2 items",
+		`{"name":"Rex","age":3,"kind":"cow"}`:              `$.kind: must be one of ["cat","dog"]`,
+		`{"name":"Rex","age":3,"owner":"me"}`:              "$.owner: no value is allowed here",
+	}
+	for reply, want := range suite {
+		t.Run(reply, func(t *testing.T) {
+			got, err := schema.Validate(reply)
+			if want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if string(got) != strings.TrimSpace(reply) {
+					t.Errorf("unexpected reply: %s", got)
+				}
+				return
+			}
+			if !errors.Is(err, ErrSchema) || !strings.Contains(err.Error(), want) {
+				t.Errorf("expected %q, got %v", want, err)
+			}
+		})
+	}
+}
+
+func Test_parseJSONSchema_Invalid(t *testing.T) {
+	for _, schema := range []string{
+		`{`, `"string"`, `[]`,
+		`{"$ref":"#/definitions/dog"}`,
+		`{"type":"object","properties":{"name":{"type":"string","format":"email"}}}`,
+		`{"anyOf":[{"type":"string"}]}`,
+		`{"type":"array","items":{"oneOf":[true]}}`,
+		`{"type":"string","pattern":"(?=x)"}`,
+	} {
+		if _, err := parseJSONSchema([]byte(schema)); err == nil {
+			t.Errorf("%s: expected error", schema)
+		}
+	}
+}
+
+func TestAskJSON_FeedsBackProblems(t *testing.T) {
+	schema, _ := parseJSONSchema([]byte(testSchema))
+	p := &fakeProvider{
+		resp:    newFakeResponse(`{"name":"Rex","age":3}`),
+		replies: []gptResponse{newFakeResponse(`{"name":"Rex"}`)},
+	}
+
+	c, reply, err := conversation{}.AskJSON(context.Background(), "a dog", schema, 1, options{provider: p, noCache: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(reply) != `{"name":"Rex","age":3}` {
+		t.Errorf("unexpected reply: %s", reply)
+	}
+	if len(p.got) != 2 {
+		t.Fatalf("expected a retry, got %d requests", len(p.got))
+	}
+	if p.got[0].ResponseFormat == nil || p.got[0].ResponseFormat.Type != "json_object" {
+		t.Errorf("expected JSON mode, got %#v", p.got[0].ResponseFormat)
+	}
+	if m := p.got[0].Messages[0]; m.Role != roleSystem || !strings.Contains(m.Content, `"required"`) {
+		t.Errorf("expected schema in a system message: %#v", m)
+	}
+	if q := p.got[0].Messages[1].Content; q != "a dog" {
+		t.Errorf("expected the question as is: %q", q)
+	}
+	if feedback := p.got[1].Messages[3].Content; !strings.Contains(feedback, `missing required property "age"`) {
+		t.Errorf("expected problems fed back: %q", feedback)
+	}
+	if len(c) != 4 {
+		t.Errorf("unexpected conversation: %#v", c)
+	}
+}
+
+func TestAskJSON_DoesNotCacheInvalidReplies(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	schema, _ := parseJSONSchema([]byte(testSchema))
+	p := &fakeProvider{
+		resp:    newFakeResponse(`{"name":"Rex","age":3}`),
+		replies: []gptResponse{newFakeResponse(`{"name":"Rex"}`)},
+	}
+	opts := options{provider: p, cache: responseCache{dir: t.TempDir(), ttl: time.Hour}}
+
+	if _, _, err := (conversation{}).AskJSON(context.Background(), "a dog", schema, 1, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, reply, err := (conversation{}).AskJSON(context.Background(), "a dog", schema, 1, opts); err != nil || string(reply) != `{"name":"Rex","age":3}` {
+		t.Fatalf("unexpected reply: %s, %v", reply, err)
+	}
+	if len(p.got) != 3 {
+		t.Errorf("expected the invalid reply asked again and the valid one cached, got %d requests", len(p.got))
+	}
+}
+
+func TestAskJSON_GivesUp(t *testing.T) {
+	schema, _ := parseJSONSchema([]byte(testSchema))
+	p := newFakeProvider("not json")
+
+	_, reply, err := conversation{}.AskJSON(context.Background(), "a dog", schema, 2, options{provider: p, noCache: true})
+	if !errors.Is(err, ErrSchema) {
+		t.Errorf("expected schema error, got %v", err)
+	}
+	if reply != nil || len(p.got) != 3 {
+		t.Errorf("expected 3 attempts and no reply, got %d and %s", len(p.got), reply)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const sessionsDir string = "sessions"
+
+var ErrNoSessions = errors.New("no saved sessions")
+
+type session struct {
+	Name     string       `json:"name"`
+	Updated  time.Time    `json:"updated"`
+	Messages conversation `json:"messages"`
+	Tree     *chatNode    `json:"tree,omitempty"`
+	Params   *gptParams   `json:"params,omitempty"`
+	Model    gptModel     `json:"model,omitempty"`
+}
+
+// newSessionName names a session after the time it starts, with a random
+// suffix so that sessions started within the same second stay apart.
+func newSessionName() string {
+	return fmt.Sprintf("%s-%04x", time.Now().Format("20060102-150405"), rand.Intn(1<<16))
+}
+
+func getSessionsDir() (string, error) {
+	cfgDir, err := getGlobalConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cfgDir, sessionsDir), nil
+}
+
+func getSessionFilepath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", errors.New("invalid session name: " + name)
+	}
+	dir, err := getSessionsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+func saveSession(s session) error {
+	file, err := getSessionFilepath(s.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	s.Updated = time.Now()
+	cnt, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a half-written session
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, cnt, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func loadSession(name string) (session, error) {
+	var s session
+	file, err := getSessionFilepath(name)
+	if err != nil {
+		return s, err
+	}
+
+	cnt, err := os.ReadFile(file)
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(cnt, &s); err != nil {
+		return s, err
+	}
+	s.Name = name
+	return s, nil
+}
+
+// listSessions returns saved sessions, most recently updated first.
+func listSessions() ([]session, error) {
+	dir, err := getSessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]session, 0, len(files))
+	for _, file := range files {
+		s, err := loadSession(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Updated.After(sessions[j].Updated)
+	})
+	return sessions, nil
+}
+
+func lastSession() (session, error) {
+	sessions, err := listSessions()
+	if err != nil {
+		return session{}, err
+	}
+	if len(sessions) == 0 {
+		return session{}, ErrNoSessions
+	}
+	return sessions[0], nil
+}
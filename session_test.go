@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_saveSession_loadSession(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	want := conversation{
+		message{Role: roleSystem, Content: "sys"},
+		message{Role: roleUser, Content: "hi"},
+		message{Role: roleGpt, Content: "hello"},
+	}
+	if err := saveSession(session{Name: "test", Messages: want}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s, err := loadSession("test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Name != "test" {
+		t.Errorf("unexpected name: %q", s.Name)
+	}
+	if len(s.Messages) != len(want) || s.Messages.Last() != "hello" {
+		t.Errorf("unexpected messages: %#v", s.Messages)
+	}
+	if s.Updated.IsZero() {
+		t.Error("expected updated time to be set")
+	}
+}
+
+func Test_getSessionFilepath_RejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"", "../escape", "a/b", ".hidden"} {
+		if _, err := getSessionFilepath(name); err == nil {
+			t.Errorf("expected error for %q", name)
+		}
+	}
+}
+
+func Test_lastSession(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if _, err := lastSession(); !errors.Is(err, ErrNoSessions) {
+		t.Errorf("expected no sessions error, got %v", err)
+	}
+
+	saveSession(session{Name: "older"})
+	time.Sleep(10 * time.Millisecond)
+	saveSession(session{Name: "newer"})
+
+	s, err := lastSession()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Name != "newer" {
+		t.Errorf("expected most recent session, got %q", s.Name)
+	}
+
+	sessions, _ := listSessions()
+	if len(sessions) != 2 {
+		t.Errorf("expected two sessions, got %d", len(sessions))
+	}
+}
+
+func Test_newSessionName_DiffersWithinASecond(t *testing.T) {
+	names := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		name := newSessionName()
+		if _, err := getSessionFilepath(name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		names[name] = true
+	}
+	if len(names) < 2 {
+		t.Errorf("expected sessions started together to get different names, got %v", names)
+	}
+}
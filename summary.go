@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultSummaryMessages int = 6
+
+	summaryInstructions string = "Summarize the following conversation between a user and an assistant. " +
+		"Keep it short, but preserve facts, decisions, names and any code the conversation depends on."
+)
+
+type SummaryConfig struct {
+	Enabled   bool `json:",omitempty"`
+	Threshold int  `json:",omitempty"` // Tokens, defaults to 3/4 of the context window
+	Messages  int  `json:",omitempty"` // How many of the oldest messages to summarize at once
+}
+
+type summaryPolicy struct {
+	enabled   bool
+	threshold int
+	messages  int
+}
+
+func newSummaryPolicy(cfg SummaryConfig) summaryPolicy {
+	x := summaryPolicy{
+		enabled:   cfg.Enabled,
+		threshold: cfg.Threshold,
+		messages:  defaultSummaryMessages,
+	}
+	if cfg.Messages > 1 {
+		x.messages = cfg.Messages
+	}
+	return x
+}
+
+// due reports whether the conversation has grown past the threshold.
+func (x summaryPolicy) due(c conversation, opts options) bool {
+	if !x.enabled {
+		return false
+	}
+	threshold := x.threshold
+	if threshold == 0 {
+		threshold = opts.window.budget(opts.model) * 3 / 4
+	}
+	return threshold > 0 && c.Tokens() > threshold
+}
+
+func (x message) IsSummary() bool {
+	return len(x.Summarized) > 0
+}
+
+// compact replaces the oldest messages of the conversation with a summary
+// written by the model. The summary message keeps the originals around.
+func (x conversation) compact(ctx context.Context, opts options) (conversation, error) {
+	start := 0
+	for start < len(x) && x[start].Role == roleSystem && !x[start].IsSummary() {
+		start++
+	}
+	end := min(start+opts.summary.messages, len(x)-2) // Keep the latest exchange as is
+	for end > start && x[end].Role == roleTool {
+		end-- // Keep tool results with the call asking for them
+	}
+	if end-start < 2 {
+		return x, nil
+	}
+
+	originals := conversation{}
+	var transcript strings.Builder
+	for _, m := range x[start:end] {
+		if m.IsSummary() {
+			originals = append(originals, m.Summarized...)
+			transcript.WriteString("Summary of earlier conversation:\n")
+		} else {
+			originals = append(originals, m)
+			transcript.WriteString(string(m.Role) + ":\n")
+		}
+		transcript.WriteString(m.Content)
+		transcript.WriteString("\n\n")
+	}
+
+	req := gptMsg{
+		Model: opts.model,
+		Messages: conversation{
+			message{Role: roleSystem, Content: summaryInstructions},
+			message{Role: roleUser, Content: transcript.String()},
+		},
+	}
+	raw, err := opts.send(ctx, req, nil)
+	if err != nil {
+		return x, err
+	}
+	opts.recordUsage(raw)
+	if len(raw.Choices) == 0 || raw.Choices[0].Message.Content == "" {
+		return x, errors.New("empty summary")
+	}
+
+	summary := message{
+		Role:       roleSystem,
+		Content:    fmt.Sprintf("Summary of the earlier conversation: %s", strings.TrimSpace(raw.Choices[0].Message.Content)),
+		Summarized: originals,
+	}
+	compacted := make(conversation, 0, len(x)-(end-start)+1)
+	compacted = append(compacted, x[:start]...)
+	compacted = append(compacted, summary)
+	return append(compacted, x[end:]...), nil
+}
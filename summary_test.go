@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newLongConversation() conversation {
+	return conversation{
+		message{Role: roleSystem, Content: "sys"},
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+		message{Role: roleUser, Content: "q2"},
+		message{Role: roleGpt, Content: "a2"},
+		message{Role: roleUser, Content: "q3"},
+		message{Role: roleGpt, Content: "a3"},
+	}
+}
+
+func Test_summaryPolicy_due(t *testing.T) {
+	c := newLongConversation()
+	if (summaryPolicy{threshold: 1}).due(c, options{}) {
+		t.Error("expected disabled policy to never be due")
+	}
+	if !(summaryPolicy{enabled: true, threshold: 10}).due(c, options{}) {
+		t.Error("expected policy to be due past the threshold")
+	}
+	if (summaryPolicy{enabled: true, threshold: 1000}).due(c, options{}) {
+		t.Error("expected policy to not be due under the threshold")
+	}
+	if (summaryPolicy{enabled: true}).due(c, options{model: "local-model"}) {
+		t.Error("expected no default threshold for unknown models")
+	}
+}
+
+func Test_conversation_compact(t *testing.T) {
+	p := newFakeProvider("they talked")
+	opts := options{provider: p, noCache: true, summary: summaryPolicy{enabled: true, messages: 4}}
+
+	c, err := newLongConversation().compact(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(c) != 4 {
+		t.Fatalf("expected 4 oldest messages to be replaced: %#v", c)
+	}
+	if c[0].Content != "sys" {
+		t.Error("expected system prompt to be kept")
+	}
+	if !c[1].IsSummary() || c[1].Role != roleSystem || !strings.Contains(c[1].Content, "they talked") {
+		t.Errorf("expected summary message: %#v", c[1])
+	}
+	if len(c[1].Summarized) != 4 || c[1].Summarized[0].Content != "q1" {
+		t.Errorf("expected original messages to be kept: %#v", c[1].Summarized)
+	}
+	if !strings.Contains(p.got[0].Messages[1].Content, "q2") {
+		t.Errorf("expected transcript in summary request: %#v", p.got[0].Messages)
+	}
+
+	// Summaries are folded into the next one
+	c = append(c, message{Role: roleUser, Content: "q4"}, message{Role: roleGpt, Content: "a4"})
+	c, err = c.compact(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !c[1].IsSummary() || len(c[1].Summarized) != 6 {
+		t.Errorf("expected summaries to fold originals together: %#v", c[1])
+	}
+}
+
+func Test_conversation_compact_KeepsLatestToolExchange(t *testing.T) {
+	call := toolCall{ID: "call_1", Type: "function", Function: toolCallFunction{Name: "list_dir"}}
+	c := conversation{
+		message{Role: roleUser, Content: "q1"},
+		message{Role: roleGpt, Content: "a1"},
+		message{Role: roleUser, Content: "q2"},
+		message{Role: roleGpt, ToolCalls: []toolCall{call}},
+		message{Role: roleTool, ToolCallID: "call_1", Content: "main.go"},
+		message{Role: roleGpt, Content: "a2"},
+	}
+	opts := options{provider: newFakeProvider("they talked"), noCache: true, summary: summaryPolicy{enabled: true, messages: 4}}
+
+	got, err := c.compact(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 4 || len(got[0].Summarized) != 3 || got[1].ToolCalls == nil || got[3].Content != "a2" {
+		t.Errorf("expected the tool call, its result and the answer to be kept: %#v", got)
+	}
+}
+
+func TestAsk_SummarizesWhenDue(t *testing.T) {
+	p := newFakeProvider("a4")
+	p.replies = []gptResponse{newFakeResponse("they talked")}
+	opts := options{
+		provider: p,
+		noCache:  true,
+		summary:  summaryPolicy{enabled: true, threshold: 10, messages: 4},
+	}
+
+	c, err := newLongConversation().Ask(context.Background(), "q4", opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.got) != 2 {
+		t.Fatalf("expected summary and question requests, got %d", len(p.got))
+	}
+	for _, m := range p.got[1].Messages {
+		if m.Summarized != nil {
+			t.Error("expected summarized originals to stay out of the request")
+		}
+	}
+	if len(c) != 6 || !c[1].IsSummary() || c.Last() != "a4" {
+		t.Errorf("unexpected conversation: %#v", c)
+	}
+}
+
+func TestAsk_ChecksBudgetBeforeSummarizing(t *testing.T) {
+	p := newFakeProvider("a4")
+	p.replies = []gptResponse{newFakeResponse("they talked")}
+	opts := options{
+		model:    gpt4,
+		provider: p,
+		noCache:  true,
+		summary:  summaryPolicy{enabled: true, threshold: 10, messages: 4},
+		budget:   budgetPolicy{perRequest: 0.0001},
+	}
+
+	if _, err := newLongConversation().Ask(context.Background(), "q4", opts); !errors.Is(err, ErrBudget) {
+		t.Errorf("expected budget error, got %v", err)
+	}
+	if len(p.got) != 0 {
+		t.Errorf("expected no summary request over budget: %#v", p.got)
+	}
+}
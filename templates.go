@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	templatesDir string = "templates"
+
+	// defaultTemplate asks the arguments, followed by whatever got piped in
+	defaultTemplate string = "{{.Args}}{{if .Stdin}}\n{{.Stdin}}{{end}}"
+)
+
+var templateExtensions = []string{".tmpl", ".txt", ".md", ""}
+
+func getTemplatesDir() (string, error) {
+	dir, err := getGlobalConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, templatesDir), nil
+}
+
+// loadTemplate reads the named template from the templates directory.
+func loadTemplate(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid template name: %q", name)
+	}
+	dir, err := getTemplatesDir()
+	if err != nil {
+		return "", err
+	}
+	for _, ext := range templateExtensions {
+		buf, err := os.ReadFile(filepath.Join(dir, name+ext))
+		if err == nil {
+			return string(buf), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no template named %s in %s", name, dir)
+}
+
+// renderPrompt builds the question out of the template. Besides .Args
+// and .Stdin, each variable is available both as .Vars.name and as .name.
+func renderPrompt(text string, args []string, stdin string, vars map[string]string) (string, error) {
+	tmpl, err := template.New("prompt").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"file": readTemplateFile}).
+		Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	data := map[string]any{}
+	for k, v := range vars {
+		data[k] = v
+	}
+	data["Args"] = strings.TrimSpace(strings.Join(args, " "))
+	data["Stdin"] = stdin
+	data["Vars"] = vars
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func readTemplateFile(path string) (string, error) {
+	buf, err := os.ReadFile(path)
+	return string(buf), err
+}
+
+// templateVars collects --var name=value flags.
+type templateVars map[string]string
+
+func (x templateVars) String() string {
+	pairs := []string{}
+	for k, v := range x {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (x templateVars) Set(value string) error {
+	name, v, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", value)
+	}
+	x[name] = v
+	return nil
+}
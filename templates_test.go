@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_renderPrompt_Default(t *testing.T) {
+	suite := []struct {
+		args  []string
+		stdin string
+		want  string
+	}{
+		{[]string{"list", "files "}, "", "list files"},
+		{[]string{"explain"}, "ls -la\n", "explain\nls -la\n"},
+		{nil, "", ""},
+	}
+	for _, test := range suite {
+		got, err := renderPrompt(defaultTemplate, test.args, test.stdin, nil)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got != test.want {
+			t.Errorf("want %q, got %q", test.want, got)
+		}
+	}
+}
+
+func Test_renderPrompt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guide.md")
+	os.WriteFile(path, []byte("Use tabs."), 0600)
+
+	text := `Review this {{.lang}} change ({{.Vars.lang}}), {{.Args}}.
+{{file "` + path + `"}}
+{{.Stdin}}`
+	got, err := renderPrompt(text, []string{"briefly"}, "diff", map[string]string{"lang": "go"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Review this go change (go), briefly.\nUse tabs.\ndiff"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if _, err := renderPrompt("{{.lang}}", nil, "", nil); err == nil {
+		t.Error("expected error for a missing variable")
+	}
+	if _, err := renderPrompt(`{{file "nope.txt"}}`, nil, "", nil); err == nil {
+		t.Error("expected error for a missing file")
+	}
+	if _, err := renderPrompt("{{", nil, "", nil); err == nil {
+		t.Error("expected error for an invalid template")
+	}
+}
+
+func Test_loadTemplate(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir, _ := getTemplatesDir()
+	os.MkdirAll(dir, 0700)
+	os.WriteFile(filepath.Join(dir, "review.tmpl"), []byte("Review {{.Stdin}}"), 0600)
+
+	got, err := loadTemplate("review")
+	if err != nil || got != "Review {{.Stdin}}" {
+		t.Errorf("unexpected template %q (%v)", got, err)
+	}
+	for _, name := range []string{"missing", "../config", ".hidden", ""} {
+		if _, err := loadTemplate(name); err == nil {
+			t.Errorf("%q: expected error", name)
+		}
+	}
+}
+
+func Test_templateVars(t *testing.T) {
+	vars := templateVars{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(vars, "var", "")
+	if err := fs.Parse([]string{"--var", "lang=go", "--var", "query=a=b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if vars["lang"] != "go" || vars["query"] != "a=b" {
+		t.Errorf("unexpected variables: %#v", vars)
+	}
+	if err := vars.Set("nope"); err == nil || !strings.Contains(err.Error(), "name=value") {
+		t.Errorf("expected error, got %v", err)
+	}
+}
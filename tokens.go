@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dlclark/regexp2"
+)
+
+const (
+	windowTruncate string = "truncate"
+	windowRefuse   string = "refuse"
+
+	defaultWindowReserve int = 512
+
+	// Chat formatting overhead, as documented for cl100k based models
+	tokensPerMessage int = 3
+	tokensPerReply   int = 3
+)
+
+// cl100kPattern is the cl100k_base pre-tokenizer, splitting text into
+// the pieces that byte pair encoding then works on.
+var cl100kPattern = regexp2.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`, regexp2.None)
+
+// cl100kRanksFile holds the cl100k_base merge ranks, as published by OpenAI
+// along with tiktoken, so that tokens can be counted offline.
+//
+//go:embed cl100k_base.tiktoken.gz
+var cl100kRanksFile []byte
+
+var (
+	cl100kOnce     sync.Once
+	cl100kRankings map[string]int
+)
+
+// cl100kRanks parses the merge ranks the first time they are needed.
+func cl100kRanks() map[string]int {
+	cl100kOnce.Do(func() {
+		ranks, err := parseRanks(cl100kRanksFile)
+		if err != nil {
+			panic(fmt.Sprintf("invalid cl100k_base ranks: %v", err))
+		}
+		cl100kRankings = ranks
+	})
+	return cl100kRankings
+}
+
+var contextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	// Longest prefixes first
+	{"gpt-3.5-turbo-16k", 16385},
+	{"gpt-3.5-turbo-0301", 4096},
+	{"gpt-3.5-turbo-0613", 4096},
+	{"gpt-3.5-turbo-instruct", 4096},
+	{"gpt-3.5-turbo", 16385}, // Since -1106
+	{"gpt-4-32k", 32768},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4o", 128000},
+	{"gpt-4-1106", 128000},
+	{"gpt-4-0125", 128000},
+	{"gpt-4", 8192},
+}
+
+// ContextWindow returns the number of tokens the model accepts, or 0 if unknown.
+func (x gptModel) ContextWindow() int {
+	for _, w := range contextWindows {
+		if strings.HasPrefix(string(x), w.prefix) {
+			return w.tokens
+		}
+	}
+	return 0
+}
+
+// maxBytePairPiece bounds the pieces merged at once, as merging takes
+// quadratic time. Longer ones, such as minified code or base64, are
+// counted in chunks of this size, which is close enough.
+const maxBytePairPiece int = 256
+
+// estimateTokens counts the cl100k_base tokens in text. That is exact
+// for the models using this encoding, bar very long words, and close
+// enough for the others.
+func estimateTokens(text string) int {
+	ranks := cl100kRanks()
+	tokens := 0
+	match, _ := cl100kPattern.FindStringMatch(text)
+	for match != nil {
+		piece := []byte(match.String())
+		for len(piece) > maxBytePairPiece {
+			tokens += bytePairCount(piece[:maxBytePairPiece], ranks)
+			piece = piece[maxBytePairPiece:]
+		}
+		tokens += bytePairCount(piece, ranks)
+		match, _ = cl100kPattern.FindNextMatch(match)
+	}
+	return tokens
+}
+
+// bytePairCount returns the number of tokens the piece encodes into,
+// merging the adjacent parts with the lowest rank until none are left.
+func bytePairCount(piece []byte, ranks map[string]int) int {
+	if _, ok := ranks[string(piece)]; ok {
+		return 1
+	}
+
+	type part struct{ start, rank int }
+	parts := make([]part, len(piece)+1)
+	rank := func(i int) int {
+		if i+2 < len(parts) {
+			if r, ok := ranks[string(piece[parts[i].start:parts[i+2].start])]; ok {
+				return r
+			}
+		}
+		return math.MaxInt
+	}
+	for i := range parts {
+		parts[i].start = i
+	}
+	for i := range parts {
+		parts[i].rank = rank(i)
+	}
+
+	for {
+		at, lowest := -1, math.MaxInt
+		for i, p := range parts {
+			if p.rank < lowest {
+				at, lowest = i, p.rank
+			}
+		}
+		if at < 0 {
+			return len(parts) - 1
+		}
+		parts = append(parts[:at+1], parts[at+2:]...)
+		parts[at].rank = rank(at)
+		if at > 0 {
+			parts[at-1].rank = rank(at - 1)
+		}
+	}
+}
+
+// parseRanks reads a gzipped tiktoken file, made of lines holding
+// a base64 encoded token and its rank.
+func parseRanks(file []byte) (map[string]int, error) {
+	r, err := gzip.NewReader(bytes.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	ranks := make(map[string]int, 100256)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		token, rank, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		buf, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, err
+		}
+		ranks[string(buf)] = n
+	}
+	return ranks, scanner.Err()
+}
+
+func (x message) Tokens() int {
+	tokens := tokensPerMessage + estimateTokens(string(x.Role)) + estimateTokens(x.Content)
+	for _, c := range x.ToolCalls {
+		tokens += estimateTokens(c.Function.Name) + estimateTokens(c.Function.Arguments)
+	}
+	return tokens
+}
+
+func (x conversation) Tokens() int {
+	tokens := tokensPerReply
+	for _, m := range x {
+		tokens += m.Tokens()
+	}
+	return tokens
+}
+
+type ContextConfig struct {
+	Strategy string `json:",omitempty"` // One of truncate or refuse
+	Limit    int    `json:",omitempty"` // Tokens, overrides the model context window
+	Reserve  int    `json:",omitempty"` // Tokens kept free for the response
+}
+
+type windowPolicy struct {
+	strategy string
+	limit    int
+	reserve  int
+}
+
+func newWindowPolicy(cfg ContextConfig) (windowPolicy, error) {
+	x := windowPolicy{
+		strategy: windowTruncate,
+		limit:    cfg.Limit,
+		reserve:  defaultWindowReserve,
+	}
+	switch cfg.Strategy {
+	case "":
+	case windowTruncate, windowRefuse:
+		x.strategy = cfg.Strategy
+	default:
+		return x, fmt.Errorf("%w: unknown context strategy %q, expected %s or %s",
+			ErrConfig, cfg.Strategy, windowTruncate, windowRefuse)
+	}
+	if cfg.Reserve > 0 {
+		x.reserve = cfg.Reserve
+	}
+	return x, nil
+}
+
+// budget returns the number of tokens available for the request, or 0
+// if there is no known limit.
+func (x windowPolicy) budget(model gptModel) int {
+	limit := x.limit
+	if limit == 0 {
+		limit = model.ContextWindow()
+	}
+	if limit == 0 {
+		return 0
+	}
+	return limit - x.reserve
+}
+
+// fit makes sure the conversation fits into the model context window,
+// dropping the oldest turns but keeping system messages if allowed to.
+func (x windowPolicy) fit(c conversation, model gptModel) (conversation, error) {
+	budget := x.budget(model)
+	if x.strategy == "" || budget <= 0 {
+		return c, nil
+	}
+
+	sizes := make([]int, len(c)) // Counted once, as that is slow for long messages
+	tokens := tokensPerReply
+	for i, m := range c {
+		sizes[i] = m.Tokens()
+		tokens += sizes[i]
+	}
+	if tokens <= budget {
+		return c, nil
+	}
+	if x.strategy != windowTruncate {
+		return c, fmt.Errorf("%w: conversation is ~%d tokens, %s allows %d",
+			ErrContextLength, tokens, model, budget)
+	}
+
+	fitted := c
+	for tokens > budget {
+		start := 0
+		for start < len(fitted) && fitted[start].Role == roleSystem {
+			start++
+		}
+		end := start + 1
+		for end < len(fitted) && fitted[end].Role != roleUser {
+			end++
+		}
+		if end >= len(fitted) {
+			return c, fmt.Errorf("%w: message is ~%d tokens, %s allows %d",
+				ErrContextLength, tokens, model, budget)
+		}
+
+		for _, n := range sizes[start:end] {
+			tokens -= n
+		}
+		trimmed := make(conversation, 0, len(fitted)-(end-start))
+		trimmed = append(trimmed, fitted[:start]...)
+		fitted = append(trimmed, fitted[end:]...)
+		sizes = append(sizes[:start:start], sizes[end:]...)
+	}
+	return fitted, nil
+}
+
+// warning describes how close the conversation is to filling up the
+// context window, once it gets close enough to matter.
+func (x windowPolicy) warning(c conversation, model gptModel) string {
+	budget := x.budget(model)
+	if budget <= 0 {
+		return ""
+	}
+	tokens := c.Tokens()
+	if tokens*5 < budget*4 {
+		return ""
+	}
+	if x.strategy == windowTruncate {
+		return fmt.Sprintf("~%d/%d tokens used, oldest messages will be dropped", tokens, budget)
+	}
+	return fmt.Sprintf("~%d/%d tokens used, context window is filling up", tokens, budget)
+}
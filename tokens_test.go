@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_estimateTokens(t *testing.T) {
+	// Counts as given by tiktoken for cl100k_base
+	suite := map[string]struct {
+		text string
+		want int
+	}{
+		"empty":       {"", 0},
+		"word":        {"hello", 1},
+		"words":       {"hello world", 2},
+		"code":        {"fmt.Println(\"Hello, World!\")", 7},
+		"long":        {"internationalization", 2},
+		"numbers":     {"1234567", 3},
+		"whitespace":  {"  leading spaces", 3},
+		"contraction": {"I'm sure they'll've done it", 8},
+		"unicode":     {"emoji 🎉🎉 and ünïcödé", 15},
+		"cjk":         {"日本語のテキストです", 9},
+		"repeated":    {strings.Repeat("x", 500), 63},
+	}
+	for name, test := range suite {
+		t.Run(name, func(t *testing.T) {
+			if got := estimateTokens(test.text); got != test.want {
+				t.Errorf("want %d tokens, got %d", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_estimateTokens_LongWords(t *testing.T) {
+	text := strings.Repeat("aZxq", 64<<10) // Like minified code or base64
+	start := time.Now()
+	tokens := estimateTokens(text)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v to count", elapsed)
+	}
+	if tokens < len(text)/4 || tokens > len(text) {
+		t.Errorf("unexpected count %d for %d bytes", tokens, len(text))
+	}
+}
+
+func Test_gptModel_ContextWindow(t *testing.T) {
+	suite := map[gptModel]int{
+		gpt3:                    16385,
+		gpt4:                    8192,
+		"gpt-4-32k-0613":        32768,
+		"gpt-3.5-turbo-16k":     16385,
+		"gpt-4o-mini":           128000,
+		"llama-2-7b-chat.Q4_0":  0,
+		"gpt-3.5-turbo-0301":    4096,
+		"gpt-3.5-turbo-0613":    4096,
+		"gpt-3.5-turbo-1106":    16385,
+		"gpt-3.5-turbo-0125":    16385,
+		"gpt-4-turbo-preview":   128000,
+		"gpt-4-1106-preview":    128000,
+		"gpt-4-0613":            8192,
+		"gpt-3.5-turbo-16k-613": 16385,
+	}
+	for model, want := range suite {
+		if got := model.ContextWindow(); got != want {
+			t.Errorf("%s: want %d, got %d", model, want, got)
+		}
+	}
+}
+
+func Test_windowPolicy_fit_Truncates(t *testing.T) {
+	c := conversation{
+		message{Role: roleSystem, Content: "You are a helpful assistant"},
+		message{Role: roleUser, Content: strings.Repeat("old question ", 50)},
+		message{Role: roleGpt, Content: strings.Repeat("old answer ", 50)},
+		message{Role: roleUser, Content: "new question"},
+	}
+	policy := windowPolicy{strategy: windowTruncate, limit: 100, reserve: 10}
+
+	got, err := policy.fit(c, gpt3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected oldest turn to be dropped: %#v", got)
+	}
+	if got[0].Role != roleSystem || got[1].Content != "new question" {
+		t.Errorf("expected system prompt and new question to be kept: %#v", got)
+	}
+	if len(c) != 4 {
+		t.Error("expected original conversation to be left alone")
+	}
+}
+
+func Test_windowPolicy_fit_Refuses(t *testing.T) {
+	c := conversation{
+		message{Role: roleUser, Content: strings.Repeat("old question ", 50)},
+		message{Role: roleUser, Content: "new question"},
+	}
+	policy := windowPolicy{strategy: windowRefuse, limit: 100, reserve: 10}
+
+	if _, err := policy.fit(c, gpt3); !errors.Is(err, ErrContextLength) {
+		t.Errorf("expected context length error, got %v", err)
+	}
+}
+
+func Test_windowPolicy_fit_ErrorsOutWhenQuestionAloneIsTooLong(t *testing.T) {
+	c := conversation{
+		message{Role: roleUser, Content: strings.Repeat("long question ", 500)},
+	}
+	policy := windowPolicy{strategy: windowTruncate, limit: 100, reserve: 10}
+
+	if _, err := policy.fit(c, gpt3); !errors.Is(err, ErrContextLength) {
+		t.Errorf("expected context length error, got %v", err)
+	}
+}
+
+func Test_windowPolicy_fit_SkipsUnknownModels(t *testing.T) {
+	c := conversation{message{Role: roleUser, Content: strings.Repeat("long question ", 5000)}}
+	policy, _ := newWindowPolicy(ContextConfig{})
+	if _, err := policy.fit(c, "local-model"); err != nil {
+		t.Errorf("expected unknown model to not be limited: %v", err)
+	}
+}
+
+func Test_newWindowPolicy_RejectsUnknownStrategy(t *testing.T) {
+	if _, err := newWindowPolicy(ContextConfig{Strategy: "refuse"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := newWindowPolicy(ContextConfig{Strategy: "trunacte"}); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected config error, got %v", err)
+	}
+}
+
+func Test_windowPolicy_warning(t *testing.T) {
+	policy := windowPolicy{strategy: windowTruncate, limit: 100}
+	if w := policy.warning(conversation{message{Role: roleUser, Content: "hi"}}, gpt3); w != "" {
+		t.Errorf("expected no warning, got %q", w)
+	}
+	c := conversation{message{Role: roleUser, Content: strings.Repeat("question ", 90)}}
+	if w := policy.warning(c, gpt3); w == "" {
+		t.Error("expected warning")
+	}
+}
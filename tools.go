@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultToolRounds int           = 10
+	toolOutputLimit   int           = 16 * 1024
+	toolShellTimeout  time.Duration = 30 * time.Second
+	toolGrepMatches   int           = 100
+)
+
+var ErrToolDenied = errors.New("tool call denied")
+
+// ToolsConfig sets up the tools the model may call. Each call is asked
+// about first, in the chat or on the terminal, unless --yes-tools is given.
+type ToolsConfig struct {
+	Enabled  bool                 `json:",omitempty"` // Offers the built-in tools
+	Shell    []string             `json:",omitempty"` // Commands the shell tool may run
+	Rounds   int                  `json:",omitempty"` // Tool calls answered before giving up
+	External []ExternalToolConfig `json:",omitempty"`
+}
+
+// ExternalToolConfig declares a tool run by an executable, which gets
+// the arguments as JSON on stdin and answers on stdout.
+type ExternalToolConfig struct {
+	Name        string
+	Description string          `json:",omitempty"`
+	Parameters  json.RawMessage `json:",omitempty"` // JSON schema of the arguments
+	Command     string
+	Args        []string `json:",omitempty"`
+	Timeout     int      `json:",omitempty"` // Seconds
+}
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// gptTool describes a tool to the API.
+type gptTool struct {
+	Type     string      `json:"type"`
+	Function gptFunction `json:"function"`
+}
+
+type gptFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// toolCall is a request by the model to run one of the tools.
+type toolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function toolCallFunction `json:"function"`
+}
+
+type toolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+func (x toolCall) String() string {
+	return fmt.Sprintf("%s(%s)", x.Function.Name, x.Function.Arguments)
+}
+
+// Tool is something the model may ask gptcli to run locally.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage // JSON schema of the arguments
+	Run         func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+type toolRegistry struct {
+	tools  []Tool
+	rounds int
+}
+
+func newToolRegistry(cfg ToolsConfig, root string) (toolRegistry, error) {
+	x := toolRegistry{rounds: defaultToolRounds}
+	if cfg.Rounds > 0 {
+		x.rounds = cfg.Rounds
+	}
+	if cfg.Enabled {
+		x.tools = append(x.tools, readFileTool(root), listDirTool(root), grepTool(root))
+		if len(cfg.Shell) > 0 {
+			x.tools = append(x.tools, shellTool(root, cfg.Shell))
+		}
+	}
+
+	errs := []error{}
+	for _, ext := range cfg.External {
+		t, err := externalTool(ext, root)
+		if err == nil {
+			err = x.Register(t)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return x, fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+	return x, nil
+}
+
+func (x toolRegistry) maxRounds() int {
+	if x.rounds > 0 {
+		return x.rounds
+	}
+	return defaultToolRounds
+}
+
+func (x *toolRegistry) Register(t Tool) error {
+	if !toolNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid tool name: %q", t.Name)
+	}
+	if _, ok := x.Get(t.Name); ok {
+		return fmt.Errorf("tool %s is declared twice", t.Name)
+	}
+	x.tools = append(x.tools, t)
+	return nil
+}
+
+func (x toolRegistry) Get(name string) (Tool, bool) {
+	for _, t := range x.tools {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Tool{}, false
+}
+
+// definitions describes the registered tools for the request.
+func (x toolRegistry) definitions() []gptTool {
+	if len(x.tools) == 0 {
+		return nil
+	}
+	defs := make([]gptTool, 0, len(x.tools))
+	for _, t := range x.tools {
+		defs = append(defs, gptTool{
+			Type: "function",
+			Function: gptFunction{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Parameters,
+			}})
+	}
+	return defs
+}
+
+// call runs the requested tool, turning failures into a result the
+// model can read, so that it gets a chance to recover.
+func (x toolRegistry) call(ctx context.Context, c toolCall) message {
+	result := message{Role: roleTool, ToolCallID: c.ID}
+	t, ok := x.Get(c.Function.Name)
+	if !ok {
+		result.Content = "error: unknown tool " + c.Function.Name
+		return result
+	}
+	args := json.RawMessage(c.Function.Arguments)
+	if len(bytes.TrimSpace(args)) == 0 {
+		args = json.RawMessage("{}")
+	}
+	out, err := t.Run(ctx, args)
+	if err != nil {
+		result.Content = "error: " + err.Error()
+		return result
+	}
+	result.Content = truncateOutput(out)
+	return result
+}
+
+func truncateOutput(out string) string {
+	if len(out) <= toolOutputLimit {
+		return out
+	}
+	return out[:toolOutputLimit] + "\n[output truncated]"
+}
+
+// resolvePath turns the path into one under root, refusing any that
+// would escape it, be it lexically or through symlinks.
+func resolvePath(root, path string) (string, error) {
+	if path == "" {
+		path = "."
+	}
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return "", err
+		}
+		path = rel
+	}
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("path outside of %s: %s", root, path)
+	}
+
+	real, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("path outside of %s: %s", root, path)
+	}
+	return filepath.Join(root, rel), nil
+}
+
+func readFileTool(root string) Tool {
+	return Tool{
+		Name:        "read_file",
+		Description: "Read a text file from the current directory",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"Relative path of the file"}},` +
+			`"required":["path"]}`),
+		Run: func(ctx context.Context, raw json.RawMessage) (string, error) {
+			var args struct{ Path string }
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return "", err
+			}
+			path, err := resolvePath(root, args.Path)
+			if err != nil {
+				return "", err
+			}
+			buf, err := os.ReadFile(path)
+			return string(buf), err
+		},
+	}
+}
+
+func listDirTool(root string) Tool {
+	return Tool{
+		Name:        "list_dir",
+		Description: "List the entries of a directory under the current directory",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"Relative path of the directory, defaults to the current one"}}}`),
+		Run: func(ctx context.Context, raw json.RawMessage) (string, error) {
+			var args struct{ Path string }
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return "", err
+			}
+			path, err := resolvePath(root, args.Path)
+			if err != nil {
+				return "", err
+			}
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return "", err
+			}
+			var out strings.Builder
+			for _, e := range entries {
+				out.WriteString(e.Name())
+				if e.IsDir() {
+					out.WriteString("/")
+				}
+				out.WriteString("\n")
+			}
+			return out.String(), nil
+		},
+	}
+}
+
+func grepTool(root string) Tool {
+	return Tool{
+		Name:        "grep",
+		Description: "Search the files under the current directory for lines matching a regular expression",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"pattern":{"type":"string","description":"Regular expression (RE2 syntax)"},` +
+			`"path":{"type":"string","description":"Relative path to search in, defaults to the current directory"}},` +
+			`"required":["pattern"]}`),
+		Run: func(ctx context.Context, raw json.RawMessage) (string, error) {
+			var args struct{ Pattern, Path string }
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return "", err
+			}
+			re, err := regexp.Compile(args.Pattern)
+			if err != nil {
+				return "", err
+			}
+			start, err := resolvePath(root, args.Path)
+			if err != nil {
+				return "", err
+			}
+
+			var out strings.Builder
+			matches := 0
+			err = filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return nil // Skip what cannot be read
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if d.IsDir() {
+					if path != start && strings.HasPrefix(d.Name(), ".") {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if matches >= toolGrepMatches {
+					return fs.SkipAll
+				}
+				if !d.Type().IsRegular() {
+					return nil // Symlinks may point outside of root
+				}
+				matches += grepFile(root, path, re, toolGrepMatches-matches, &out)
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+			if matches == 0 {
+				return "no matches", nil
+			}
+			return out.String(), nil
+		},
+	}
+}
+
+// grepFile writes up to limit matching lines of the file, skipping binaries.
+func grepFile(root, path string, re *regexp.Regexp, limit int, out *strings.Builder) int {
+	buf, err := os.ReadFile(path)
+	if err != nil || bytes.IndexByte(buf, 0) >= 0 {
+		return 0
+	}
+	rel, _ := filepath.Rel(root, path)
+	found := 0
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for line := 1; scanner.Scan() && found < limit; line++ {
+		if re.MatchString(scanner.Text()) {
+			fmt.Fprintf(out, "%s:%d: %s\n", rel, line, scanner.Text())
+			found++
+		}
+	}
+	return found
+}
+
+func shellTool(root string, allowed []string) Tool {
+	return Tool{
+		Name: "shell",
+		Description: "Run a command in the current directory, without a shell. Allowed commands: " +
+			strings.Join(allowed, ", "),
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"command":{"type":"string","description":"Command line, split on whitespace"}},` +
+			`"required":["command"]}`),
+		Run: func(ctx context.Context, raw json.RawMessage) (string, error) {
+			var args struct{ Command string }
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return "", err
+			}
+			argv := strings.Fields(args.Command)
+			if len(argv) == 0 {
+				return "", errors.New("empty command")
+			}
+			permitted := false
+			for _, a := range allowed {
+				permitted = permitted || a == argv[0]
+			}
+			if !permitted {
+				return "", fmt.Errorf("command not allowed: %s", argv[0])
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, toolShellTimeout)
+			defer cancel()
+			cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+			cmd.Dir = root
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				return fmt.Sprintf("%s\n%v", out, err), nil
+			}
+			return string(out), nil
+		},
+	}
+}
+
+func externalTool(cfg ExternalToolConfig, root string) (Tool, error) {
+	if cfg.Command == "" {
+		return Tool{}, fmt.Errorf("tool %s has no command", cfg.Name)
+	}
+	params := cfg.Parameters
+	if len(params) == 0 {
+		params = json.RawMessage(`{"type":"object","properties":{}}`)
+	} else if !json.Valid(params) {
+		return Tool{}, fmt.Errorf("tool %s has invalid parameters schema", cfg.Name)
+	}
+	timeout := toolShellTimeout
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+
+	return Tool{
+		Name:        cfg.Name,
+		Description: cfg.Description,
+		Parameters:  params,
+		Run: func(ctx context.Context, args json.RawMessage) (string, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			cmd := exec.CommandContext(ctx, cfg.Command, cfg.Args...)
+			cmd.Dir = root
+			cmd.Stdin = bytes.NewReader(args)
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if err != nil {
+				if msg := strings.TrimSpace(stderr.String()); msg != "" {
+					return "", fmt.Errorf("%w: %s", err, msg)
+				}
+				return "", err
+			}
+			return string(out), nil
+		},
+	}, nil
+}
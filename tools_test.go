@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestToolRoot(t *testing.T) string {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644)
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "sub", "notes.txt"), []byte("todo: write tests\n"), 0644)
+	os.WriteFile(filepath.Join(root, "blob.bin"), []byte("todo\x00"), 0644)
+	return root
+}
+
+func runTestTool(t *testing.T, reg toolRegistry, name, args string) message {
+	return reg.call(context.Background(), toolCall{
+		ID:       "call_1",
+		Type:     "function",
+		Function: toolCallFunction{Name: name, Arguments: args},
+	})
+}
+
+func Test_resolvePath(t *testing.T) {
+	root := newTestToolRoot(t)
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("hunter2"), 0644)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "leak"))
+	os.Symlink(outside, filepath.Join(root, "elsewhere"))
+	os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "shortcut"))
+
+	suite := map[string]bool{
+		"":                               true,
+		".":                              true,
+		"sub/notes.txt":                  true,
+		filepath.Join(root, "main.go"):   true,
+		"shortcut/notes.txt":             true,
+		"../etc/passwd":                  false,
+		"/etc/passwd":                    false,
+		"sub/../../b":                    false,
+		"leak":                           false,
+		"elsewhere/secret":               false,
+		filepath.Join(outside, "secret"): false,
+	}
+	for path, ok := range suite {
+		_, err := resolvePath(root, path)
+		if ok && err != nil {
+			t.Errorf("%q: unexpected error: %v", path, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%q: expected path to be refused", path)
+		}
+	}
+}
+
+func Test_toolRegistry_Builtins_RefuseSymlinksOutOfRoot(t *testing.T) {
+	root := newTestToolRoot(t)
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("todo: hunter2\n"), 0644)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "leak"))
+	reg, _ := newToolRegistry(ToolsConfig{Enabled: true}, root)
+
+	if got := runTestTool(t, reg, "read_file", `{"path":"leak"}`); strings.Contains(got.Content, "hunter2") {
+		t.Errorf("expected read_file through symlink to fail: %q", got.Content)
+	}
+	if got := runTestTool(t, reg, "grep", `{"pattern":"hunter2"}`); strings.Contains(got.Content, "hunter2") {
+		t.Errorf("expected grep to skip symlinks: %q", got.Content)
+	}
+}
+
+func Test_toolRegistry_Builtins(t *testing.T) {
+	root := newTestToolRoot(t)
+	reg, err := newToolRegistry(ToolsConfig{Enabled: true, Shell: []string{"echo"}}, root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := runTestTool(t, reg, "read_file", `{"path":"sub/notes.txt"}`); got.Content != "todo: write tests\n" {
+		t.Errorf("unexpected read_file result: %q", got.Content)
+	}
+	if got := runTestTool(t, reg, "read_file", `{"path":"../secret"}`); !strings.HasPrefix(got.Content, "error:") {
+		t.Errorf("expected read_file outside of root to fail: %q", got.Content)
+	}
+	if got := runTestTool(t, reg, "list_dir", `{}`); got.Content != "blob.bin\nmain.go\nsub/\n" {
+		t.Errorf("unexpected list_dir result: %q", got.Content)
+	}
+	if got := runTestTool(t, reg, "grep", `{"pattern":"todo"}`); got.Content != "sub/notes.txt:1: todo: write tests\n" {
+		t.Errorf("unexpected grep result: %q", got.Content)
+	}
+	if got := runTestTool(t, reg, "shell", `{"command":"echo hello"}`); got.Content != "hello\n" {
+		t.Errorf("unexpected shell result: %q", got.Content)
+	}
+	if got := runTestTool(t, reg, "shell", `{"command":"rm -rf sub"}`); !strings.Contains(got.Content, "not allowed") {
+		t.Errorf("expected shell command to be refused: %q", got.Content)
+	}
+	if got := runTestTool(t, reg, "nope", `{}`); got.ToolCallID != "call_1" || !strings.Contains(got.Content, "unknown tool") {
+		t.Errorf("unexpected result for unknown tool: %#v", got)
+	}
+}
+
+func Test_toolRegistry_Definitions(t *testing.T) {
+	reg, _ := newToolRegistry(ToolsConfig{}, ".")
+	if defs := reg.definitions(); defs != nil {
+		t.Errorf("expected no tools unless enabled, got %#v", defs)
+	}
+
+	reg, _ = newToolRegistry(ToolsConfig{Enabled: true}, ".")
+	defs := reg.definitions()
+	names := []string{}
+	for _, d := range defs {
+		names = append(names, d.Function.Name)
+		if !json.Valid(d.Function.Parameters) {
+			t.Errorf("%s: invalid parameters schema", d.Function.Name)
+		}
+	}
+	if strings.Join(names, ",") != "read_file,list_dir,grep" {
+		t.Errorf("unexpected tools: %v", names)
+	}
+}
+
+func Test_toolRegistry_External(t *testing.T) {
+	root := newTestToolRoot(t)
+	var cfg ToolsConfig
+	err := json.Unmarshal([]byte(`{"External":[
+		{"Name":"ticket","Description":"Look up a ticket","Command":"cat",
+		 "Parameters":{"type":"object","properties":{"id":{"type":"string"}}}},
+		{"Name":"failing","Command":"sh","Args":["-c","echo broken >&2; exit 3"]}
+	]}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := newToolRegistry(cfg, root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defs := reg.definitions()
+	if len(defs) != 2 || defs[0].Function.Name != "ticket" || !strings.Contains(string(defs[0].Function.Parameters), `"id"`) {
+		t.Errorf("unexpected definitions: %#v", defs)
+	}
+	if got := runTestTool(t, reg, "ticket", `{"id":"OPS-1"}`); got.Content != `{"id":"OPS-1"}` {
+		t.Errorf("expected arguments on stdin to come back on stdout, got %q", got.Content)
+	}
+	if got := runTestTool(t, reg, "failing", ``); !strings.Contains(got.Content, "broken") {
+		t.Errorf("expected stderr in the error, got %q", got.Content)
+	}
+}
+
+func Test_toolRegistry_External_Invalid(t *testing.T) {
+	suite := map[string]ToolsConfig{
+		"no command":   {External: []ExternalToolConfig{{Name: "x"}}},
+		"bad name":     {External: []ExternalToolConfig{{Name: "no spaces", Command: "true"}}},
+		"bad schema":   {External: []ExternalToolConfig{{Name: "x", Command: "true", Parameters: json.RawMessage(`{`)}}},
+		"builtin name": {Enabled: true, External: []ExternalToolConfig{{Name: "grep", Command: "grep"}}},
+	}
+	for test, cfg := range suite {
+		t.Run(test, func(t *testing.T) {
+			if _, err := newToolRegistry(cfg, "."); !errors.Is(err, ErrConfig) {
+				t.Errorf("expected configuration error, got %v", err)
+			}
+		})
+	}
+}
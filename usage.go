@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const usageLedgerFile string = "usage.jsonl"
+
+// ModelPrice is the cost of a model, in dollars per thousand tokens.
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+var modelPrices = []struct {
+	prefix string
+	price  ModelPrice
+}{
+	// Longest prefixes first
+	{"gpt-3.5-turbo-16k", ModelPrice{Prompt: 0.003, Completion: 0.004}},
+	{"gpt-3.5-turbo", ModelPrice{Prompt: 0.0015, Completion: 0.002}},
+	{"gpt-4-32k", ModelPrice{Prompt: 0.06, Completion: 0.12}},
+	{"gpt-4-turbo", ModelPrice{Prompt: 0.01, Completion: 0.03}},
+	{"gpt-4-1106", ModelPrice{Prompt: 0.01, Completion: 0.03}},
+	{"gpt-4-0125", ModelPrice{Prompt: 0.01, Completion: 0.03}},
+	{"gpt-4o-mini", ModelPrice{Prompt: 0.00015, Completion: 0.0006}},
+	{"gpt-4o", ModelPrice{Prompt: 0.005, Completion: 0.015}},
+	{"gpt-4", ModelPrice{Prompt: 0.03, Completion: 0.06}},
+}
+
+type gptUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// messageUsage is what producing a message took.
+type messageUsage struct {
+	Model            gptModel `json:"model"`
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	Cost             float64  `json:"cost"`
+}
+
+func (x messageUsage) Tokens() int {
+	return x.PromptTokens + x.CompletionTokens
+}
+
+// Add sums up two usages, either of which may be missing.
+func (x *messageUsage) Add(y *messageUsage) *messageUsage {
+	if x == nil {
+		return y
+	}
+	if y == nil {
+		return x
+	}
+	sum := *x
+	sum.PromptTokens += y.PromptTokens
+	sum.CompletionTokens += y.CompletionTokens
+	sum.Cost += y.Cost
+	return &sum
+}
+
+// priceOf returns the price of the model, preferring configured prices.
+func priceOf(model gptModel, prices map[gptModel]ModelPrice) (ModelPrice, bool) {
+	if price, ok := prices[model]; ok {
+		return price, true
+	}
+	for _, p := range modelPrices {
+		if strings.HasPrefix(string(model), p.prefix) {
+			return p.price, true
+		}
+	}
+	return ModelPrice{}, false
+}
+
+func (x ModelPrice) Cost(promptTokens, completionTokens int) float64 {
+	return (float64(promptTokens)*x.Prompt + float64(completionTokens)*x.Completion) / 1000
+}
+
+func newMessageUsage(model gptModel, usage gptUsage, prices map[gptModel]ModelPrice) messageUsage {
+	x := messageUsage{
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	}
+	if price, ok := priceOf(model, prices); ok {
+		x.Cost = price.Cost(usage.PromptTokens, usage.CompletionTokens)
+	}
+	return x
+}
+
+// Usage totals up what producing the conversation took.
+func (x conversation) Usage() messageUsage {
+	total := messageUsage{}
+	for _, m := range x {
+		if m.Usage == nil {
+			continue
+		}
+		total.PromptTokens += m.Usage.PromptTokens
+		total.CompletionTokens += m.Usage.CompletionTokens
+		total.Cost += m.Usage.Cost
+	}
+	return total
+}
+
+// UsageByModel sums up the usage of the messages per model, in the
+// order the models were first used.
+func (x conversation) UsageByModel() []messageUsage {
+	totals := []messageUsage{}
+	for _, m := range x {
+		if m.Usage == nil {
+			continue
+		}
+		idx := 0
+		for idx < len(totals) && totals[idx].Model != m.Usage.Model {
+			idx++
+		}
+		if idx == len(totals) {
+			totals = append(totals, messageUsage{Model: m.Usage.Model})
+		}
+		totals[idx].PromptTokens += m.Usage.PromptTokens
+		totals[idx].CompletionTokens += m.Usage.CompletionTokens
+		totals[idx].Cost += m.Usage.Cost
+	}
+	return totals
+}
+
+type usageRecord struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session,omitempty"`
+	messageUsage
+}
+
+// usageLedger is a local append-only log of API spend.
+type usageLedger struct {
+	path string
+}
+
+func newUsageLedger() usageLedger {
+	dir, err := getGlobalConfigDir()
+	if err != nil {
+		return usageLedger{}
+	}
+	return usageLedger{path: filepath.Join(dir, usageLedgerFile)}
+}
+
+func (x usageLedger) Record(session string, usage messageUsage) error {
+	if x.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(x.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(x.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(usageRecord{
+		Time:         time.Now(),
+		Session:      session,
+		messageUsage: usage,
+	})
+}
+
+func (x usageLedger) Records() ([]usageRecord, error) {
+	if x.path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(x.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []usageRecord{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r usageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+type usageTotal struct {
+	Key      string
+	Requests int
+	messageUsage
+}
+
+// aggregateUsage totals records by day, model or session.
+func aggregateUsage(records []usageRecord, by string) ([]usageTotal, error) {
+	var keyOf func(usageRecord) string
+	switch by {
+	case "day":
+		keyOf = func(r usageRecord) string { return r.Time.Local().Format("2006-01-02") }
+	case "model":
+		keyOf = func(r usageRecord) string { return string(r.Model) }
+	case "session":
+		keyOf = func(r usageRecord) string {
+			if r.Session == "" {
+				return "(none)"
+			}
+			return r.Session
+		}
+	default:
+		return nil, fmt.Errorf("unknown usage grouping: %s", by)
+	}
+
+	totals := map[string]*usageTotal{}
+	for _, r := range records {
+		key := keyOf(r)
+		if _, ok := totals[key]; !ok {
+			totals[key] = &usageTotal{Key: key}
+		}
+		t := totals[key]
+		t.Requests++
+		t.PromptTokens += r.PromptTokens
+		t.CompletionTokens += r.CompletionTokens
+		t.Cost += r.Cost
+	}
+
+	result := make([]usageTotal, 0, len(totals))
+	for _, t := range totals {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+func usageCommand(by string, ledger usageLedger, out io.Writer) error {
+	records, err := ledger.Records()
+	if err != nil {
+		return err
+	}
+	totals, err := aggregateUsage(records, by)
+	if err != nil {
+		return err
+	}
+
+	var sum usageTotal
+	for _, t := range totals {
+		fmt.Fprintf(out, "%s\t%d requests\t%d tokens\t$%.4f\n", t.Key, t.Requests, t.Tokens(), t.Cost)
+		sum.Requests += t.Requests
+		sum.PromptTokens += t.PromptTokens
+		sum.CompletionTokens += t.CompletionTokens
+		sum.Cost += t.Cost
+	}
+	fmt.Fprintf(out, "total\t%d requests\t%d tokens\t$%.4f\n", sum.Requests, sum.Tokens(), sum.Cost)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseGptResponse_Usage(t *testing.T) {
+	buf, _ := os.ReadFile("testdata/resp.json")
+	x, _ := parseGptResponse(buf)
+	if x.Usage == nil {
+		t.Fatal("expected usage")
+	}
+	if x.Usage.PromptTokens != 32 || x.Usage.CompletionTokens != 142 || x.Usage.TotalTokens != 174 {
+		t.Errorf("unexpected usage: %#v", x.Usage)
+	}
+}
+
+func Test_newMessageUsage(t *testing.T) {
+	usage := gptUsage{PromptTokens: 1000, CompletionTokens: 500}
+
+	x := newMessageUsage(gpt4, usage, nil)
+	if math.Abs(x.Cost-0.06) > 1e-9 {
+		t.Errorf("unexpected gpt-4 cost: %v", x.Cost)
+	}
+
+	x = newMessageUsage("local", usage, nil)
+	if x.Cost != 0 {
+		t.Errorf("expected unknown model to be free, got %v", x.Cost)
+	}
+
+	x = newMessageUsage("local", usage, map[gptModel]ModelPrice{"local": {Prompt: 1, Completion: 2}})
+	if math.Abs(x.Cost-2) > 1e-9 {
+		t.Errorf("expected configured price to be used, got %v", x.Cost)
+	}
+}
+
+func TestAsk_AttachesAndRecordsUsage(t *testing.T) {
+	p := newFakeProvider("hello")
+	p.resp.Usage = &gptUsage{PromptTokens: 10, CompletionTokens: 20, TotalTokens: 30}
+	ledger := usageLedger{path: filepath.Join(t.TempDir(), usageLedgerFile)}
+
+	c, err := conversation{}.Ask(context.Background(), "hi", options{
+		model:    gpt3,
+		provider: p,
+		noCache:  true,
+		ledger:   ledger,
+		session:  "test",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c[1].Usage == nil || c[1].Usage.Tokens() != 30 || c[1].Usage.Model != gpt3 {
+		t.Errorf("expected usage on the assistant message: %#v", c[1].Usage)
+	}
+	if c.Usage().Tokens() != 30 {
+		t.Errorf("unexpected conversation usage: %#v", c.Usage())
+	}
+
+	records, err := ledger.Records()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 || records[0].Session != "test" || records[0].Tokens() != 30 {
+		t.Errorf("unexpected ledger records: %#v", records)
+	}
+}
+
+func Test_aggregateUsage(t *testing.T) {
+	day1 := time.Date(2023, 4, 1, 12, 0, 0, 0, time.Local)
+	day2 := day1.Add(24 * time.Hour)
+	records := []usageRecord{
+		{Time: day1, Session: "a", messageUsage: messageUsage{Model: gpt3, PromptTokens: 10, Cost: 1}},
+		{Time: day1, Session: "b", messageUsage: messageUsage{Model: gpt4, PromptTokens: 20, Cost: 2}},
+		{Time: day2, Session: "a", messageUsage: messageUsage{Model: gpt4, PromptTokens: 30, Cost: 3}},
+	}
+
+	byDay, _ := aggregateUsage(records, "day")
+	if len(byDay) != 2 || byDay[0].Requests != 2 || byDay[0].Cost != 3 {
+		t.Errorf("unexpected daily usage: %#v", byDay)
+	}
+	byModel, _ := aggregateUsage(records, "model")
+	if len(byModel) != 2 || byModel[1].Key != string(gpt4) || byModel[1].Tokens() != 50 {
+		t.Errorf("unexpected model usage: %#v", byModel)
+	}
+	bySession, _ := aggregateUsage(records, "session")
+	if len(bySession) != 2 || bySession[0].Key != "a" || bySession[0].Cost != 4 {
+		t.Errorf("unexpected session usage: %#v", bySession)
+	}
+	if _, err := aggregateUsage(records, "wat"); err == nil {
+		t.Error("expected error for unknown grouping")
+	}
+}
+
+func Test_usageCommand(t *testing.T) {
+	ledger := usageLedger{path: filepath.Join(t.TempDir(), usageLedgerFile)}
+	ledger.Record("a", messageUsage{Model: gpt3, PromptTokens: 10, CompletionTokens: 5, Cost: 0.5})
+
+	var out bytes.Buffer
+	if err := usageCommand("model", ledger, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), string(gpt3)) || !strings.Contains(out.String(), "$0.5000") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+}